@@ -0,0 +1,552 @@
+/*
+Package bigd collects file info from a directory and concurrently processes
+the files by decompressing their contents. Each processed file produces a
+Result holding the decompressed data or related error, and results are
+delivered over a channel as they become available.
+
+Supported compression formats are gzip (".gz"), zlib (".zz"), bzip2
+(".bz2"), zstd (".zst"), LZ4 frames (".lz4"), and xz (".xz"). Formats are
+selected by file extension, or by magic bytes if Processor.Magic is set.
+Files selected by extension which lack the magic bytes of their format fail
+with ErrBadMagic. Compressed tar archives (e.g. ".tar.gz" or ".tgz") are
+expanded into a result per entry unless Processor.Streaming is set. Further
+formats can be added with Register.
+
+The "width" of concurrency is set by Processor.Width (defaulting to the
+constant DefaultWidth). Parallelism is scheduled properly regardless of CPUs
+available, and the processing will be serial if only one CPU is available
+(or if width is 1). Width, in this case, helps control the maximum available
+goroutines to limit the usage of RAM. Decoders for some formats, notably xz,
+allocate a dictionary per file (up to 64MB), so peak memory also grows with
+width. A budget set by Processor.MemBudget only accounts for decompressed
+bytes held by results, not decoder state, so lower the width when processing
+large xz files.
+*/
+package bigd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	// DefaultWidth is the default amount of goroutines running the digest
+	// function.
+	DefaultWidth = 16
+
+	// DefaultSettle is the default duration a watched file must remain
+	// unchanged for before it is processed (see Processor.Watch).
+	DefaultSettle = time.Second
+
+	// minRetryDelay and maxRetryDelay bound the exponential backoff between
+	// retries.
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+
+	// defaultReadBuffer is the size of the buffer compressed contents are
+	// read through when no size is set (as with bufio.NewReader).
+	defaultReadBuffer = 4096
+)
+
+var (
+	// ErrUnknownFormat is wrapped by a result error (see Error) when the
+	// compression format of a file cannot be determined.
+	ErrUnknownFormat = errors.New("unknown compression format")
+
+	// ErrTimeout is set as a result error when a file is not processed
+	// within the allowed timeout.
+	ErrTimeout = errors.New("processing timed out")
+
+	// ErrTooLarge is wrapped by a result error (see Error) when the
+	// compressed or decompressed size of a file exceeds the allowed size.
+	ErrTooLarge = errors.New("file too large")
+
+	// ErrRatioExceeded is wrapped by a result error (see Error) when the
+	// ratio of decompressed to compressed size of a file exceeds the allowed
+	// ratio.
+	ErrRatioExceeded = errors.New("expansion ratio exceeded")
+
+	// ErrFileLimit is wrapped by a result error (see Error) when a file
+	// cannot be opened because the limit of open files set by the OS has
+	// been reached (see Processor.MaxOpen).
+	ErrFileLimit = errors.New("open file limit reached")
+
+	// ErrHashMismatch is wrapped by a result error (see Error) when the hash
+	// of decompressed contents differs from the expected hash (see Options).
+	ErrHashMismatch = errors.New("hash mismatch")
+
+	// ErrBadMagic is wrapped by a result error (see Error) when the leading
+	// bytes of a file do not match the compression format selected by its
+	// extension (e.g. a ".gz" file which is not gzip).
+	ErrBadMagic = errors.New("bad magic")
+
+	// ErrPostRejected is wrapped by the error returned by Poster.Post when
+	// the endpoint responds with a status other than 2xx.
+	ErrPostRejected = errors.New("post rejected")
+
+	// ErrFetchRejected is wrapped by a result error (see Error) when a file
+	// located at a URL is responded to with a status other than 2xx.
+	ErrFetchRejected = errors.New("fetch rejected")
+
+	// ErrCanceled is received from the error channel of Funnel when
+	// processing is canceled before all files are sent out, so that
+	// cancellation can be told apart from failures of the source.
+	ErrCanceled = errors.New("canceled")
+)
+
+// Logger receives diagnostic messages. It is satisfied by *log.Logger, and
+// a slog.Handler can be adapted with slog.NewLogLogger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Transform wraps a reader of file contents, e.g. to decrypt them (see
+// Processor.PreDecompress).
+type Transform func(io.Reader) (io.Reader, error)
+
+// Digester processes a single file into a result. A Digester can be set
+// on a Processor to replace its processing of each file (e.g. to cache
+// results, or to process files remotely, or to avoid real files in tests).
+// The Processor itself is the default Digester.
+type Digester interface {
+	// Digest processes the file located at path and returns its result. The
+	// result index is set by the caller. Digest must be safe for concurrent
+	// use.
+	Digest(ctx context.Context, path string) Result
+}
+
+// Processor holds the settings used to collect and process files. Settings
+// must not be modified while processing.
+type Processor struct {
+	// FS is the filesystem files are collected from and opened in, which
+	// allows failures to be injected (e.g. in tests). Paths are then as
+	// expected by the filesystem. A nil FS uses the operating system's
+	// filesystem, with paths as accepted by os.Open.
+	FS fs.FS
+
+	// Client is used to fetch files located at "http://" or "https://"
+	// URLs, which are processed like any other file. Responses other than
+	// 2xx fail with ErrFetchRejected. A nil Client uses http.DefaultClient.
+	Client *http.Client
+
+	// Width controls the amount of goroutines running the digest function.
+	Width int
+
+	// Adaptive enables the scaling of digesters while processing, starting
+	// from one and bounded by MaxWidth. A digester is added while files wait
+	// on busy digesters, and one is retired while results wait on the
+	// consumer, which finds a width suited to the workload without tuning.
+	Adaptive bool
+
+	// MaxWidth caps the amount of digesters when Adaptive is set. A max
+	// width of 0 uses Width.
+	MaxWidth int
+
+	// Deterministic assigns each file to a digester by its index modulo the
+	// width, rather than to whichever digester is free, so that runs
+	// (e.g. their profiles) are comparable. Throughput suffers since a slow
+	// file holds up the files behind it. Deterministic cannot be used with
+	// Adaptive.
+	Deterministic bool
+
+	// Buffer controls the amount of results which may be held while waiting
+	// on the consumer, so that digesters are not stalled by a slow
+	// consumer. Buffered results hold decompressed data in memory, so up to
+	// Buffer whole files (plus one per digester) may be held at once.
+	Buffer int
+
+	// MemBudget limits the total amount of decompressed bytes held by
+	// buffered results at once, regardless of width. Each file holds part of
+	// the budget, estimated by its compressed size before it is read and
+	// reconciled with its decompressed size after, until Release is called
+	// on its result. Streamed results do not hold any of the budget. A
+	// budget of 0 disables the limit. MemBudget cannot be used with Ordered,
+	// since held results could then stall the result being waited on.
+	MemBudget int64
+
+	// MaxOpen limits the amount of files held open at once, regardless of
+	// width, for systems with a low limit of open files. A file is held from
+	// before it is opened until it is closed, and streamed files are held
+	// until their stream is fully written. A max of 0 disables the limit.
+	// MaxOpen cannot be used with Ordered while streaming, since held
+	// streams could then stall the stream being waited on.
+	MaxOpen int
+
+	// ReadBuffer controls the size in bytes of the buffer compressed
+	// contents are read through before decompression (and magic bytes are
+	// peeked from). Larger buffers mean fewer, larger reads, which helps on
+	// spinning disks and networked filesystems. A size of 0 uses 4096
+	// bytes, the default of the bufio package.
+	ReadBuffer int
+
+	// Rate limits the amount of files started per second, which spares
+	// shared storage from bursts of opens. It is a ceiling independent of
+	// Width: digesters wait their turn, so fewer files start than Width
+	// allows while the rate is reached, and Width still bounds the files
+	// in progress. Waiting digesters count as busy, so an Adaptive width may
+	// grow toward MaxWidth. A rate of 0 disables the limit.
+	Rate float64
+
+	// Depth controls the depth of subdirectories files are collected from.
+	// A depth of 1 skips all subdirectories.
+	Depth int
+
+	// Filter holds the criteria which files must meet to be collected.
+	Filter Filter
+
+	// Follow enables the following of symbolic links while collecting, so
+	// that linked files are collected and linked directories are descended
+	// into (while depth allows). Links back to a directory already being
+	// descended through are skipped. By default, links are skipped.
+	Follow bool
+
+	// Strict makes any error while collecting fail the collection. By
+	// default, subdirectories which cannot be read due to their permissions
+	// are skipped, and their errors are recorded instead (see
+	// FilesInfo.Skipped).
+	Strict bool
+
+	// Sort selects the order files are collected in: "name" (by full path),
+	// "size", or "mtime", each ascending with ties left in name order. An
+	// empty name keeps the order of discovery (see FilesInfoIn).
+	Sort string
+
+	// Settle controls the duration a watched file must remain unchanged for
+	// before it is provided (see Watch). A duration of 0 is replaced by
+	// DefaultSettle.
+	Settle time.Duration
+
+	// Magic enables the selection of compression formats by the leading
+	// bytes of each file rather than by file extension.
+	Magic bool
+
+	// Single limits the reading of gzip files to their first member. By
+	// default, all concatenated members are read.
+	Single bool
+
+	// Tolerant enables the skipping of corrupt members of concatenated gzip
+	// files, by scanning for the header of the next member, so that as much
+	// as possible is recovered from partly corrupt files. Each member is
+	// buffered until its checksum is verified (even when verifying), so
+	// nothing of a corrupt member is kept, and size limits (see MaxSize and
+	// MaxRatio) apply while it is buffered. Skipped members are counted by
+	// each result (see Result.SkippedMembers), whose contents are then
+	// incomplete. Trailing bytes holding no further member header (e.g.
+	// padding) are not counted. Members within tar archives are not skipped.
+	// Tolerant cannot be used with Single, or with Streaming since streamed
+	// results are sent before any member is skipped.
+	Tolerant bool
+
+	// Ordered enables the sending of results in the order files are
+	// provided (see Ordered).
+	Ordered bool
+
+	// OrderBuffer bounds how many files ahead of the next result to be sent
+	// may be started when Ordered is set, which bounds the results held out
+	// of order. Once reached, newer files wait for a slow file to finish
+	// rather than letting held results grow. A bound of 0 disables the
+	// limit.
+	OrderBuffer int
+
+	// SkipEmpty enables the dropping of results for files which decompress
+	// to nothing. Results with errors are still sent. Empty files are not
+	// skipped when streaming since results are sent before files are read.
+	// SkipEmpty is applied by Funnel (and Process), not by WorkerPool.
+	SkipEmpty bool
+
+	// Count limits the amount of files taken from the source, so that
+	// files past the limit are never started (e.g. to sample a large
+	// directory). Each tar archive counts as a single file. A count of 0
+	// disables the limit. Count is applied by Funnel (and Process), not by
+	// WorkerPool.
+	Count int
+
+	// Streaming enables the streaming of decompressed contents through each
+	// result rather than buffering whole files in memory (see Result.Stream).
+	// Contents are copied from the decompressor to the stream as they are
+	// read, so memory stays flat regardless of file sizes. The file and
+	// decompressor are held open by the digester until the stream is read to
+	// its end or closed, so each stream must be closed by the consumer.
+	Streaming bool
+
+	// Verify enables the reading and discarding of decompressed contents,
+	// so that results hold only the decompressed size and any error (e.g. a
+	// failed gzip checksum). Nothing is buffered, and compressed tar archives
+	// are verified whole. Verify cannot be used with Streaming.
+	Verify bool
+
+	// Timeout limits the amount of time a single file may take to process.
+	// A timeout of 0 disables the limit.
+	Timeout time.Duration
+
+	// MaxSize limits the compressed and decompressed sizes of a single file
+	// in bytes. The decompressed size is checked while reading, so that
+	// small files which expand enormously are caught before exhausting
+	// memory. A max size of 0 disables the limit.
+	MaxSize int64
+
+	// MaxRatio limits the ratio of decompressed to compressed size of a
+	// single file. The ratio is checked while reading, so that decompression
+	// bombs are aborted early. A max ratio of 0 disables the limit.
+	MaxRatio float64
+
+	// Retries controls the amount of times processing a file is retried
+	// when failing with a transient error (e.g. an I/O error on a networked
+	// filesystem). Errors caused by malformed contents are not retried.
+	Retries int
+
+	// KeepPartial enables the keeping of contents decompressed before a read
+	// error (e.g. of a truncated file) in the result, which is then marked
+	// as partial (see Result.Partial) so that the prefix can be inspected.
+	// Streamed and verified contents are not held, so are never kept.
+	KeepPartial bool
+
+	// Hash selects the hash computed over decompressed contents (see
+	// NewHash). An empty name disables hashing. Streamed contents are not
+	// hashed since their results are sent before the contents are read,
+	// though expected hashes (see Options) are still checked.
+	Hash string
+
+	// Dedup enables the marking of results whose hash was already held by
+	// an earlier result (see Result.Duplicate), and requires Hash. The first
+	// occurrence is the first to be processed, which is not necessarily the
+	// lowest index. Dedup cannot be used with Streaming, since streamed
+	// contents are not hashed.
+	Dedup bool
+
+	// Sniff enables the detection of the content type of decompressed
+	// contents (e.g. "text/plain; charset=utf-8"), which is held by each
+	// result. Detection uses the leading bytes of contents already read (see
+	// http.DetectContentType), so streamed and verified contents are not
+	// sniffed.
+	Sniff bool
+
+	// TextStats enables the gathering of text statistics of decompressed
+	// contents (see TextStats), which are held by each result. Streamed
+	// contents are not included since their results are sent first.
+	TextStats bool
+
+	// Grep, if set, filters decompressed contents (including those of tar
+	// entries, streamed, and verified contents) to the lines it matches,
+	// as they are read. Lines are matched without their newline. Hashes,
+	// sizes, and statistics are of the filtered contents, while size limits
+	// (see MaxSize and MaxRatio) apply to the contents as decompressed, so
+	// files without matches are empty (see SkipEmpty). A Regexp is safe for
+	// concurrent use, so one is shared by all digesters.
+	Grep *regexp.Regexp
+
+	// Gate, if set, allows processing to be paused and resumed between files
+	// (see Gate).
+	Gate *Gate
+
+	// Metrics, if set, is updated while processing (see PublishMetrics).
+	Metrics *Metrics
+
+	// PreDecompress, if set, wraps the contents of each file before they
+	// are decompressed, e.g. to decrypt files which were compressed and
+	// then encrypted. Compression formats selected by magic bytes are
+	// detected from the wrapped contents.
+	PreDecompress Transform
+
+	// PostDecompress, if set, wraps the decompressed contents of each file,
+	// e.g. to decrypt files which were encrypted and then compressed. Size
+	// limits (see MaxSize and MaxRatio) apply to the wrapped contents.
+	// Readers returned by either transform are not closed, and an error
+	// fails the file at StageInit.
+	PostDecompress Transform
+
+	// Digester, if set, processes each file in place of the Processor (see
+	// Processor.Digest). Results are still subject to the memory budget,
+	// ordering, skipping, callbacks, and metrics, but decompression settings
+	// (e.g. Streaming, Timeout, Retries, and Hash) and tar expansion are
+	// left to the Digester. Files are not held against MaxOpen since a
+	// Digester may not open them.
+	Digester Digester
+
+	// OnProgress, if set, is called with the path of a file and the amount
+	// of its decompressed bytes copied so far, after each chunk copied while
+	// its contents are streamed (or verified), so that the progress of large
+	// files can be followed. Buffered contents are not reported. OnProgress
+	// is called from multiple digesters, so must be safe for concurrent use.
+	OnProgress func(path string, n int64)
+
+	// OnError, if set, is called with the path and error of each file which
+	// fails to process, as the failure occurs. Errors are still set on the
+	// relevant results. OnError is called from multiple digesters, so must
+	// be safe for concurrent use. For streamed results, it is called once
+	// the stream has finished.
+	OnError func(path string, err error)
+
+	// OnResult, if set, is called with each result on the digester which
+	// produced it, before the result is sent. This lets results be pushed
+	// elsewhere (e.g. to relevant microservices, see Poster) with the
+	// concurrency of the digesters rather than through the consumer. A
+	// returned error is set as the result error unless one is already set.
+	// The provided context carries the metadata of the processed file (see
+	// FileFrom). OnResult must be safe for concurrent use, and cannot be
+	// used with Streaming. Panics within OnResult are not recovered, since
+	// they occur on the digester.
+	OnResult func(ctx context.Context, r Result) error
+
+	// Logger, if set, receives diagnostic messages while processing, such as
+	// file errors as they occur and the cancellation of processing.
+	Logger Logger
+
+	// Slow enables a slowing of the digest function to aid the
+	// understanding of designed concurrency by changing the output timing.
+	Slow bool
+}
+
+// NewProcessor returns a Processor with a width of DefaultWidth and a depth
+// of 1, which collects files with any of the supported extensions.
+func NewProcessor() *Processor {
+	return &Processor{
+		Width:  DefaultWidth,
+		Depth:  1,
+		Filter: Filter{Exts: Extensions()},
+	}
+}
+
+// Validate returns an error if any settings of the Processor are invalid.
+func (pr *Processor) Validate() error {
+	if pr.Width < 1 {
+		return errors.New("width must be at least 1")
+	}
+
+	if pr.MaxWidth < 0 {
+		return errors.New("max width must not be negative")
+	}
+
+	if pr.Deterministic && pr.Adaptive {
+		return errors.New("deterministic cannot be used with adaptive width")
+	}
+
+	if pr.Buffer < 0 {
+		return errors.New("buffer must not be negative")
+	}
+
+	if pr.Tolerant && pr.Single {
+		return errors.New("tolerant cannot be used with single")
+	}
+
+	if pr.Tolerant && pr.Streaming {
+		return errors.New("tolerant cannot be used with streaming")
+	}
+
+	if pr.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+
+	if pr.MaxSize < 0 {
+		return errors.New("max size must not be negative")
+	}
+
+	if pr.MaxRatio < 0 {
+		return errors.New("max ratio must not be negative")
+	}
+
+	if pr.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+
+	if pr.MemBudget < 0 {
+		return errors.New("memory budget must not be negative")
+	}
+
+	if pr.MemBudget > 0 && pr.Ordered {
+		return errors.New("memory budget cannot be used with ordered results")
+	}
+
+	if pr.MaxOpen < 0 {
+		return errors.New("max open must not be negative")
+	}
+
+	if pr.ReadBuffer < 0 {
+		return errors.New("read buffer must not be negative")
+	}
+
+	if pr.MaxOpen > 0 && pr.Ordered && pr.Streaming {
+		return errors.New("max open cannot be used with ordered results while streaming")
+	}
+
+	if pr.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+
+	if pr.OrderBuffer < 0 {
+		return errors.New("order buffer must not be negative")
+	}
+
+	if pr.Depth < 1 {
+		return errors.New("depth must be at least 1")
+	}
+
+	if pr.Settle < 0 {
+		return errors.New("settle must not be negative")
+	}
+
+	if pr.OnResult != nil && pr.Streaming {
+		return errors.New("result callback cannot be used while streaming")
+	}
+
+	if pr.Verify && pr.Streaming {
+		return errors.New("verify cannot be used while streaming")
+	}
+
+	if pr.Filter.MinSize < 0 || pr.Filter.MaxSize < 0 {
+		return errors.New("filter sizes must not be negative")
+	}
+
+	if _, err := filepath.Match(pr.Filter.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pr.Filter.Pattern, err)
+	}
+
+	if _, ok := sorts[pr.Sort]; pr.Sort != "" && !ok {
+		return fmt.Errorf("unknown sort %q", pr.Sort)
+	}
+
+	if _, ok := hashes[pr.Hash]; pr.Hash != "" && !ok {
+		return fmt.Errorf("unknown hash %q", pr.Hash)
+	}
+
+	if pr.Dedup && pr.Hash == "" {
+		return errors.New("dedup requires a hash")
+	}
+
+	if pr.Dedup && pr.Streaming {
+		return errors.New("dedup cannot be used with streaming")
+	}
+
+	return nil
+}
+
+// Process collects the files within dir, and returns a channel of results
+// which is closed once all files have been processed. Processing stops
+// early if ctx is done.
+func (pr *Processor) Process(ctx context.Context, dir string) (<-chan Result, error) {
+	if err := pr.Validate(); err != nil {
+		return nil, err
+	}
+
+	fsi, err := pr.FilesInfoIn(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, _ := pr.Funnel(ctx, fsi.Source())
+
+	return rs, nil
+}
+
+// Process is a convenience function which calls Process on a Processor
+// returned by NewProcessor.
+func Process(ctx context.Context, dir string) (<-chan Result, error) {
+	return NewProcessor().Process(ctx, dir)
+}
@@ -0,0 +1,62 @@
+package bigd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/daved/groupthink-bigd/bigd/bigdtest"
+)
+
+// BenchmarkFunnel measures the throughput of processing generated gzip
+// files as a function of width and file size. Files are written once per
+// size by bigdtest.WriteFixtures, so committed testdata is not relied on.
+//
+// Baseline (go test -bench Funnel -benchtime 20x ./bigd, linux/amd64, 1
+// CPU, files on ext4), in MB/s of decompressed contents. Width does not
+// help on a single CPU since decompression is CPU bound, so expect it to
+// scale with the CPUs available elsewhere:
+//
+//	size     width=1  width=4  width=16
+//	1KB         22.5     24.7      23.4
+//	64KB        54.2     55.2      52.5
+//	1024KB      75.6     70.1      76.5
+func BenchmarkFunnel(b *testing.B) {
+	const files = 32
+
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		dir := b.TempDir()
+		if _, err := bigdtest.WriteFixtures(dir, files, size); err != nil {
+			b.Fatal(err)
+		}
+
+		for _, width := range []int{1, 4, 16} {
+			name := fmt.Sprintf("size=%dKB/width=%d", size>>10, width)
+
+			b.Run(name, func(b *testing.B) {
+				pr := NewProcessor()
+				pr.Width = width
+
+				fsi, err := pr.FilesInfoIn(dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.SetBytes(int64(files * size))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					rs, _ := pr.Funnel(context.Background(), fsi.Source())
+
+					for r := range rs {
+						if r.Err != nil {
+							b.Fatal(r.Err)
+						}
+						r.Release()
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Package bigdtest provides helpers for testing and benchmarking code which
+// uses package bigd, kept apart so that they are not part of its API.
+package bigdtest
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+)
+
+// WriteFixtures writes n gzip files into dir, each holding size bytes of
+// decompressed contents, and returns their paths. Files are named like those
+// in testdata (e.g. "file0000.gz"). Contents are pseudo-random hex text
+// seeded by the file number, so that the files are reproducible and their
+// compression is neither trivial nor impossible. Existing files are
+// overwritten.
+func WriteFixtures(dir string, n, size int) ([]string, error) {
+	ps := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		p := path.Join(dir, fmt.Sprintf("file%04d.gz", i))
+		if err := writeFixture(p, int64(i), size); err != nil {
+			return ps, err
+		}
+
+		ps = append(ps, p)
+	}
+
+	return ps, nil
+}
+
+// writeFixture writes a single gzip file located at p holding size bytes of
+// hex text generated from the provided seed.
+func writeFixture(p string, seed int64, size int) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	gzw := gzip.NewWriter(f)
+	rnd := rand.New(rand.NewSource(seed))
+
+	// Each random byte is encoded as two hex characters.
+	raw := make([]byte, 2048)
+	buf := make([]byte, hex.EncodedLen(len(raw)))
+
+	for left := size; left > 0; {
+		_, _ = rnd.Read(raw)
+		hex.Encode(buf, raw)
+
+		n := len(buf)
+		if left < n {
+			n = left
+		}
+
+		if _, err := gzw.Write(buf[:n]); err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		left -= n
+	}
+
+	if err := gzw.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,96 @@
+package bigd
+
+import (
+	"context"
+	"sync"
+)
+
+// budget is a semaphore over bytes which limits the total amount of
+// decompressed data held at once.
+type budget struct {
+	size int64
+
+	mu   sync.Mutex
+	used int64
+	wake chan struct{}
+}
+
+// newBudget returns a budget of the provided size. A size of 0 or less
+// results in a nil budget, which is a no-op.
+func newBudget(size int64) *budget {
+	if size <= 0 {
+		return nil
+	}
+
+	return &budget{size: size, wake: make(chan struct{})}
+}
+
+// resize changes the amount held by a caller from held to want, blocking
+// until enough of the budget is available, and returns the new amount held.
+// Amounts greater than the budget are capped so that a single large file
+// cannot block indefinitely. To grow, the amount held is released first and
+// want is acquired whole, since callers waiting while holding part of the
+// budget could otherwise each wait on another. If ctx is done while
+// blocked, nothing is held and 0 is returned.
+func (b *budget) resize(ctx context.Context, held, want int64) int64 {
+	if b == nil {
+		return 0
+	}
+
+	if want > b.size {
+		want = b.size
+	}
+
+	if want <= held {
+		b.release(held - want)
+		return want
+	}
+
+	b.release(held)
+
+	for {
+		b.mu.Lock()
+		if b.used+want <= b.size {
+			b.used += want
+			b.mu.Unlock()
+			return want
+		}
+		wake := b.wake
+		b.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
+
+// release returns n bytes to the budget, and wakes any blocked callers.
+func (b *budget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= n
+	close(b.wake)
+	b.wake = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// releaser returns a function which releases n bytes to the budget once,
+// however often it is called.
+func (b *budget) releaser(n int64) func() {
+	if b == nil || n == 0 {
+		return nil
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			b.release(n)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package bigd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMemBudgetDoesNotDeadlock(t *testing.T) {
+	// Each file compresses to a small fraction of its contents, so the
+	// files in flight hold their compressed sizes while each grows toward
+	// a decompressed size which the budget cannot grant to all of them.
+	const files = 4
+	data := gzipped(t, strings.Repeat("a", 8<<20))
+
+	fsys := fstest.MapFS{}
+	for i := 0; i < files; i++ {
+		fsys[fmt.Sprintf("file%04d.gz", i)] = &fstest.MapFile{Data: data}
+	}
+
+	pr := NewProcessor()
+	pr.FS = fsys
+	pr.Width = files
+	pr.MemBudget = int64(files * len(data))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rs, _ := funnelDir(ctx, t, pr, ".")
+
+	var n int
+	for r := range rs {
+		if r.Err != nil {
+			t.Fatalf("got error %v, want none", r.Err)
+		}
+		r.Release()
+		n++
+	}
+
+	if ctx.Err() != nil {
+		t.Fatalf("got %d of %d results before the timeout, want all", n, files)
+	}
+	if n != files {
+		t.Fatalf("got %d results, want %d", n, files)
+	}
+}
@@ -0,0 +1,38 @@
+package bigd
+
+import (
+	"context"
+	"io/fs"
+)
+
+// fileKey is the context key of the File being processed.
+type fileKey struct{}
+
+// File holds metadata of a file being processed. It is attached to the
+// context passed to Processor.OnResult, so that callbacks can make use of
+// the original size and modification time without statting files again.
+type File struct {
+	// Index is the index of the file within the provided files, as held by
+	// its results.
+	Index int
+
+	// Path is the path of the file. Results of tar archive entries share
+	// the File of their archive.
+	Path string
+
+	// Info holds the file info as determined by the digester, or nil if the
+	// file could not be statted.
+	Info fs.FileInfo
+}
+
+// withFile returns a copy of ctx which carries f.
+func withFile(ctx context.Context, f File) context.Context {
+	return context.WithValue(ctx, fileKey{}, f)
+}
+
+// FileFrom returns the File carried by ctx, and whether one was carried.
+// Contexts passed to Processor.OnResult always carry one.
+func FileFrom(ctx context.Context) (File, bool) {
+	f, ok := ctx.Value(fileKey{}).(File)
+	return f, ok
+}
@@ -0,0 +1,34 @@
+package bigd
+
+import "sync"
+
+// hashSet holds the hashes of contents already processed, so that
+// duplicate contents can be detected by concurrent digesters.
+type hashSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// newHashSet returns an empty hashSet.
+func newHashSet() *hashSet {
+	return &hashSet{seen: make(map[string]struct{})}
+}
+
+// add adds hash to the set, and reports whether it was not already held
+// (i.e. whether this is the first occurrence). A nil hashSet holds nothing,
+// so every hash is a first occurrence.
+func (s *hashSet) add(hash string) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[hash]; ok {
+		return false
+	}
+	s.seen[hash] = struct{}{}
+
+	return true
+}
@@ -0,0 +1,911 @@
+package bigd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ctxReader wraps a reader so that each read fails with the error of the
+// provided context once the context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader.
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
+
+// copyChunk is the size of the chunks copied by copyWithProgress.
+const copyChunk = 32 * 1024
+
+// copyWithProgress copies from src to dst until EOF or an error, as with
+// io.Copy, and returns the amount of bytes copied. If onProgress is not nil,
+// it is called with the amount copied so far after each chunk. The copy
+// stops with the error of ctx if ctx is done between chunks.
+func copyWithProgress(ctx context.Context, dst io.Writer, src io.Reader, onProgress func(n int64)) (int64, error) {
+	buf := make([]byte, copyChunk)
+
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return n, werr
+			}
+
+			if onProgress != nil {
+				onProgress(n)
+			}
+		}
+
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// maxReader wraps a reader so that reading more than n bytes fails with
+// ErrTooLarge.
+type maxReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader.
+func (mr *maxReader) Read(p []byte) (int, error) {
+	// Allow a single byte past the limit so that exceeding it is detected
+	// without relying on a further read.
+	if int64(len(p)) > mr.n+1 {
+		p = p[:mr.n+1]
+	}
+
+	n, err := mr.r.Read(p)
+	if int64(n) > mr.n {
+		n = int(mr.n)
+		mr.n = 0
+		return n, ErrTooLarge
+	}
+
+	mr.n -= int64(n)
+
+	return n, err
+}
+
+// ratioReader wraps a reader of decompressed contents so that reading more
+// than max times the compressed size fails with ErrRatioExceeded.
+type ratioReader struct {
+	r    io.Reader
+	size int64
+	max  float64
+	n    int64
+}
+
+// Read implements io.Reader.
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+
+	if ratio := float64(rr.n) / float64(rr.size); ratio > rr.max {
+		return n, fmt.Errorf("%w: %.1f", ErrRatioExceeded, ratio)
+	}
+
+	return n, err
+}
+
+// openFile opens the file located at p in the Processor's filesystem, or
+// fetches it if p is a URL (see fetch), and returns it along with its
+// compressed size if needed for the Processor's limits (or known from the
+// response). Returned errors are of type *Error.
+func (pr *Processor) openFile(ctx context.Context, p string) (io.ReadCloser, int64, error) {
+	if isURL(p) {
+		return pr.fetch(ctx, p)
+	}
+
+	f, err := pr.fsys().Open(p)
+	if err != nil {
+		if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+			err = fmt.Errorf("%w: %w", ErrFileLimit, err)
+		}
+		return nil, 0, &Error{Stage: StageOpen, Path: p, Err: err}
+	}
+
+	var size int64
+	if pr.MaxSize > 0 || pr.MaxRatio > 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, &Error{Stage: StageOpen, Path: p, Err: err}
+		}
+
+		size = fi.Size()
+	}
+
+	return f, size, nil
+}
+
+// open opens the file located at p (see openFile), and returns a reader of its
+// decompressed contents along with the gzip header (if any), the extension
+// of the compression format selected, and a function which closes the file
+// and decompressor. A format (extension) which is not empty overrides the
+// Processor's selection of the compression format. The selected format is
+// also returned with errors which occur once it is known. If skipped is not
+// nil and the Processor is tolerant, corrupt gzip members are skipped (see
+// tolerantReader) and counted in skipped as the contents are read. The
+// file is closed early if ctx is done so that any blocked read is released.
+// Returned errors are of type *Error.
+func (pr *Processor) open(ctx context.Context, p, format string, skipped *int) (io.Reader, *Header, string, func(), error) {
+	f, size, err := pr.openFile(ctx, p)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	if pr.MaxSize > 0 && size > pr.MaxSize {
+		_ = f.Close()
+		return nil, nil, "", nil, &Error{Stage: StageOpen, Path: p, Err: ErrTooLarge}
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = f.Close()
+	})
+
+	closeFile := func() {
+		stop()
+		_ = f.Close()
+	}
+
+	var in io.Reader = f
+	if pr.PreDecompress != nil {
+		if in, err = pr.PreDecompress(f); err != nil {
+			closeFile()
+			return nil, nil, "", nil, &Error{Stage: StageInit, Path: p, Err: err}
+		}
+	}
+
+	rbs := pr.ReadBuffer
+	if rbs <= 0 {
+		rbs = defaultReadBuffer
+	}
+	br := bufio.NewReaderSize(in, rbs)
+
+	ext := format
+	if ext == "" {
+		ext, err = formatExt(namePath(p), br, pr.Magic)
+		if err != nil {
+			closeFile()
+			return nil, nil, "", nil, &Error{Stage: StageInit, Path: p, Err: err}
+		}
+	}
+
+	// Formats not selected by magic bytes must still match them.
+	if format != "" || !pr.Magic {
+		if err := checkMagic(ext, br); err != nil {
+			closeFile()
+			return nil, nil, ext, nil, &Error{Stage: StageInit, Path: p, Err: err}
+		}
+	}
+
+	// Gzip members are read through a rewindReader if tolerant, so that
+	// corrupt members can be scanned past (see tolerantReader).
+	var dsrc io.Reader = br
+	var rw *rewindReader
+	if pr.Tolerant && skipped != nil {
+		rw = newRewindReader(br)
+		dsrc = rw
+	}
+
+	dcr, err := newDecompressor(ext, dsrc)
+	if err != nil {
+		closeFile()
+		return nil, nil, ext, nil, &Error{Stage: StageInit, Path: p, Err: err}
+	}
+
+	var hdr *Header
+	if gzr, ok := dcr.(*gzip.Reader); ok {
+		hdr = newHeader(gzr.Header)
+
+		if pr.Single {
+			gzr.Multistream(false)
+		}
+
+		// Members are buffered whole, so the size limits also apply to the
+		// contents as decompressed, before any are buffered.
+		if rw != nil {
+			lr := pr.limit(ctxReader{ctx: ctx, r: gzr}, size)
+			dcr = newTolerantReader(gzr, rw, lr, skipped)
+		}
+	} else if rw != nil {
+		rw.record = false
+	}
+
+	// Stop reading promptly if ctx is done.
+	var src io.Reader = ctxReader{ctx: ctx, r: dcr}
+	if pr.PostDecompress != nil {
+		if src, err = pr.PostDecompress(src); err != nil {
+			_ = dcr.Close()
+			closeFile()
+			return nil, nil, ext, nil, &Error{Stage: StageInit, Path: p, Err: err}
+		}
+	}
+
+	src = pr.limit(src, size)
+
+	closeAll := func() {
+		_ = dcr.Close()
+		closeFile()
+	}
+
+	return src, hdr, ext, closeAll, nil
+}
+
+// limit wraps a reader of decompressed contents so that the Processor's
+// size limits are applied, where size is the compressed size of the file
+// (0 if unknown, in which case the ratio is not limited).
+func (pr *Processor) limit(r io.Reader, size int64) io.Reader {
+	if pr.MaxSize > 0 {
+		r = &maxReader{r: r, n: pr.MaxSize}
+	}
+
+	// Empty files cannot be decompressed, so are left to fail as usual.
+	if pr.MaxRatio > 0 && size > 0 {
+		r = &ratioReader{r: r, size: size, max: pr.MaxRatio}
+	}
+
+	return r
+}
+
+// decoded holds the decompressed contents of a file along with the gzip
+// header (if any), the selected format, and the amount of corrupt gzip
+// members skipped.
+type decoded struct {
+	data    string
+	hdr     *Header
+	format  string
+	skipped int
+}
+
+// decompress opens the file located at p (see open) and returns its
+// decompressed contents (filtered by the Processor's grep, if set) along
+// with the gzip header (if any), the selected format, and the amount of
+// corrupt members skipped (if tolerant). If w is not nil,
+// the contents are instead copied to w (reporting progress to the
+// Processor's OnProgress, if set) and the returned data is empty. If h is
+// not nil, the contents are also written to h as they are read. Returned
+// errors are of type *Error, and read errors are returned along with the
+// contents read before them.
+func (pr *Processor) decompress(ctx context.Context, p, format string, w, h io.Writer) (decoded, error) {
+	var skipped int
+	src, hdr, ext, closeAll, err := pr.open(ctx, p, format, &skipped)
+	if err != nil {
+		return decoded{format: ext}, err
+	}
+	defer closeAll()
+
+	if pr.Grep != nil {
+		src = newGrepReader(src, pr.Grep)
+	}
+
+	if h != nil {
+		src = io.TeeReader(src, h)
+	}
+
+	if w != nil {
+		var onProgress func(int64)
+		if pr.OnProgress != nil {
+			onProgress = func(n int64) {
+				pr.OnProgress(p, n)
+			}
+		}
+
+		if _, err = copyWithProgress(ctx, w, src, onProgress); err != nil {
+			return decoded{format: ext, skipped: skipped}, &Error{Stage: StageRead, Path: p, Err: err}
+		}
+
+		return decoded{hdr: hdr, format: ext, skipped: skipped}, nil
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		d := decoded{data: string(data), format: ext, skipped: skipped}
+		return d, &Error{Stage: StageRead, Path: p, Err: err}
+	}
+
+	return decoded{data: string(data), hdr: hdr, format: ext, skipped: skipped}, nil
+}
+
+// decompressTimeout calls decompress on a separate goroutine, and abandons
+// it with ErrTimeout if the Processor's timeout elapses first. If the parent
+// context ends first, its error is returned instead. ErrTimeout is not
+// wrapped with a stage since the stage reached is unknown, and no format is
+// returned with it. Abandoning the work closes the file, and the goroutine
+// exits once its pending read returns since its final send is buffered.
+func (pr *Processor) decompressTimeout(parent context.Context, p, format string, w, h io.Writer) (decoded, error) {
+	ctx, cancel := context.WithTimeout(parent, pr.Timeout)
+	defer cancel()
+
+	type output struct {
+		d   decoded
+		err error
+	}
+
+	c := make(chan output, 1)
+	go func() {
+		d, err := pr.decompress(ctx, p, format, w, h)
+		c <- output{d, err}
+	}()
+
+	select {
+	case o := <-c:
+		return o.d, o.err
+	case <-ctx.Done():
+		if parent.Err() == nil {
+			return decoded{}, ErrTimeout
+		}
+		return decoded{}, parent.Err()
+	}
+}
+
+// sniff returns the content type of data as detected from its leading bytes
+// (see http.DetectContentType).
+func sniff(data string) string {
+	if len(data) > 512 {
+		data = data[:512]
+	}
+
+	return http.DetectContentType([]byte(data))
+}
+
+// retryable reports whether the provided error looks transient (e.g. an I/O
+// error on a networked filesystem) rather than being caused by malformed
+// contents, which will not improve. Once contents have been streamed, only
+// errors which occurred before any reads are retryable.
+func retryable(err error, streamed bool) bool {
+	var e *Error
+	if !errors.As(err, &e) || e.Stage == StageInit {
+		return false
+	}
+
+	if streamed && e.Stage != StageOpen {
+		return false
+	}
+
+	return errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, ErrFileLimit) ||
+		errors.Is(err, fs.ErrNotExist)
+}
+
+// retryDelay returns the delay before the retry following the provided
+// attempt. The delay doubles with each attempt, up to maxRetryDelay.
+func retryDelay(attempt int) time.Duration {
+	d := minRetryDelay
+	for i := 0; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+
+	return d
+}
+
+// wait blocks for the provided duration, and reports whether it did so
+// without ctx being done first.
+func wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// digest processes the files located at the provided task paths, and sends
+// out a new result for each, until tasks is closed or a value is received
+// from retire. Files are not taken while the Processor's gate is paused.
+// Files are started within the limits held by sh. Results can also be
+// passed on to relevant microservices from here (see Processor.OnResult).
+func (pr *Processor) digest(ctx context.Context, tasks <-chan task, retire <-chan struct{}, c chan<- Result, sh *shared) {
+	for {
+		// Hold off on further files while paused.
+		if !pr.Gate.wait(ctx) {
+			return
+		}
+
+		var t task
+		var ok bool
+
+		select {
+		case t, ok = <-tasks:
+			if !ok {
+				return
+			}
+		case <-retire:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		// Wait for the file to be allowed to start.
+		if !sh.ow.admit(ctx, t.idx) {
+			return
+		}
+
+		if sh.rate != nil {
+			if err := sh.rate.Wait(ctx); err != nil {
+				return
+			}
+		}
+
+		pr.Metrics.active(1)
+		ok = pr.digestTask(ctx, t, c, sh)
+		pr.Metrics.active(-1)
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// digestTask processes the file located at the provided task path, and sends
+// out a new result. When streaming, the result is sent before the file is
+// processed so that the decompressed contents can be copied through the
+// result's stream as they are read. False is returned if ctx is done before
+// the result is sent.
+func (pr *Processor) digestTask(ctx context.Context, t task, c chan<- Result, sh *shared) bool {
+	p := t.path
+	r := Result{Index: t.idx, Path: p, Size: t.size}
+
+	// Determine unknown sizes (and info for the result callback), and
+	// leave any error to be reported when the file is opened.
+	if r.Size == 0 || pr.OnResult != nil {
+		fi, err := fs.Stat(pr.fsys(), p)
+		if err == nil && r.Size == 0 {
+			r.Size = fi.Size()
+		}
+
+		if pr.OnResult != nil {
+			f := File{Index: t.idx, Path: p}
+			if err == nil {
+				f.Info = fi
+			}
+
+			ctx = withFile(ctx, f)
+		}
+	}
+
+	if pr.Digester != nil {
+		return pr.digestWith(ctx, t, r, c, sh)
+	}
+
+	// Expand tar archives into a result per entry. Streamed and verified
+	// archives are left whole since entries must be read in sequence, and
+	// archives with an expected hash since the hash covers the whole.
+	if !pr.Streaming && !pr.Verify && t.opts.Hash == "" && isTar(p) {
+		return pr.digestTar(ctx, r, t.opts.Format, c, sh)
+	}
+
+	// Hold an open file from before any stream is sent, so that a consumer
+	// reading streams in turn never waits on a file which cannot be opened.
+	if !sh.fds.acquire(ctx) {
+		return false
+	}
+
+	var pw *io.PipeWriter
+	if pr.Streaming {
+		r.Stream, pw = io.Pipe()
+
+		select {
+		case c <- r:
+		case <-ctx.Done():
+			sh.fds.release()
+			return false
+		}
+
+		// Unblock writes to a stream the consumer has abandoned once ctx
+		// is done, so that the digester can return.
+		stop := context.AfterFunc(ctx, func() {
+			_ = pw.CloseWithError(ctx.Err())
+		})
+		defer stop()
+	}
+
+	// Hold part of the memory budget while buffering, estimated by the
+	// compressed size and reconciled with the decompressed size after.
+	buffered := pw == nil && !pr.Verify
+	var held int64
+	if buffered {
+		held = sh.mem.resize(ctx, 0, r.Size)
+	}
+
+	pr.digestFile(ctx, t, &r, pw)
+	sh.fds.release()
+
+	if buffered {
+		held = sh.mem.resize(ctx, held, r.DataSize)
+		r.release = sh.mem.releaser(held)
+	}
+
+	r.skip = pr.SkipEmpty && pw == nil && r.Err == nil && r.DataSize == 0
+
+	if pr.Slow {
+		time.Sleep(time.Second)
+	}
+
+	pr.report(ctx, &r, sh.seen)
+
+	if pw != nil {
+		_ = pw.CloseWithError(r.Err)
+		return true
+	}
+
+	select {
+	case c <- r:
+		return true
+	case <-ctx.Done():
+		r.Release()
+		return false
+	}
+}
+
+// digestWith processes the file described by r using the Processor's
+// Digester, and sends out its result. The result size is kept if the
+// Digester leaves it unset, and the data size is taken from the data unless
+// contents are streamed. False is returned if ctx is done before the result
+// is sent.
+func (pr *Processor) digestWith(ctx context.Context, t task, r Result, c chan<- Result, sh *shared) bool {
+	dr := pr.Digester.Digest(ctx, t.path)
+	dr.Index = t.idx
+
+	if dr.Path == "" {
+		dr.Path = r.Path
+	}
+
+	if dr.Size == 0 {
+		dr.Size = r.Size
+	}
+
+	if dr.Stream == nil {
+		if dr.DataSize == 0 {
+			dr.DataSize = int64(len(dr.Data))
+		}
+
+		dr.release = sh.mem.releaser(sh.mem.resize(ctx, 0, dr.DataSize))
+	}
+
+	dr.skip = pr.SkipEmpty && dr.Stream == nil && dr.Err == nil && dr.DataSize == 0
+
+	pr.report(ctx, &dr, sh.seen)
+
+	select {
+	case c <- dr:
+		return true
+	case <-ctx.Done():
+		dr.Release()
+		return false
+	}
+}
+
+// Digest implements Digester by processing the file located at path with
+// the Processor's settings, as is done for each file while processing
+// when no Digester is set. Contents are always buffered (or discarded if
+// verifying), tar archives are left whole, and the Processor's callbacks
+// are not called.
+func (pr *Processor) Digest(ctx context.Context, path string) Result {
+	r := Result{Path: path}
+	if fi, err := fs.Stat(pr.fsys(), path); err == nil {
+		r.Size = fi.Size()
+	}
+
+	pr.digestFile(ctx, task{path: path}, &r, nil)
+
+	return r
+}
+
+// digestFile processes the file located at the task path into r, retrying
+// transient errors as set by the Processor. If pw is not nil, the
+// decompressed contents are copied to it rather than held by r.
+func (pr *Processor) digestFile(ctx context.Context, t task, r *Result, pw *io.PipeWriter) {
+	p := t.path
+
+	var w io.Writer
+	if pw != nil {
+		w = pw
+
+		if pr.Metrics != nil {
+			w = countWriter{w: pw, n: &pr.Metrics.BytesOut}
+		}
+	}
+
+	// Count and discard verified contents rather than buffering them, and
+	// gather text statistics as they pass if enabled.
+	var verified expvar.Int
+	var tc *textCounter
+	if pr.Verify {
+		w = countWriter{w: ioutil.Discard, n: &verified}
+
+		if pr.TextStats {
+			tc = &textCounter{}
+			w = io.MultiWriter(w, tc)
+		}
+	}
+
+	// Hashes of streamed contents are left to the consumer since the
+	// result has already been sent, but are still checked if expected.
+	alg := pr.Hash
+	if alg == "" {
+		alg = "sha256"
+	}
+
+	var h hash.Hash
+	var hw io.Writer
+	if (pr.Hash != "" && pw == nil) || t.opts.Hash != "" {
+		h = hashes[alg]()
+		hw = h
+	}
+
+	for attempt := 0; ; attempt++ {
+		if h != nil {
+			h.Reset()
+		}
+		verified.Set(0)
+		if tc != nil {
+			*tc = textCounter{}
+		}
+
+		var d decoded
+		if pr.Timeout > 0 {
+			d, r.Err = pr.decompressTimeout(ctx, p, t.opts.Format, w, hw)
+		} else {
+			d, r.Err = pr.decompress(ctx, p, t.opts.Format, w, hw)
+		}
+		r.Data, r.Header, r.Format, r.SkippedMembers = d.data, d.hdr, d.format, d.skipped
+
+		if attempt >= pr.Retries || !retryable(r.Err, pw != nil) {
+			break
+		}
+
+		if !wait(ctx, retryDelay(attempt)) {
+			break
+		}
+	}
+
+	if r.Err != nil {
+		r.Data, r.Partial = pr.partial(r.Data)
+	}
+
+	r.DataSize = int64(len(r.Data))
+	if pr.Verify {
+		r.DataSize = verified.Value()
+	}
+
+	if h != nil && r.Err == nil {
+		sum := hex.EncodeToString(h.Sum(nil))
+		if pw == nil {
+			r.Hash = sum
+		}
+
+		if t.opts.Hash != "" && !strings.EqualFold(sum, t.opts.Hash) {
+			err := fmt.Errorf("%w: got %s, want %s", ErrHashMismatch, sum, t.opts.Hash)
+			r.Err = &Error{Stage: StageRead, Path: p, Err: err}
+		}
+	}
+
+	if pr.Sniff && pw == nil && !pr.Verify && r.Err == nil {
+		r.Type = sniff(r.Data)
+	}
+
+	if pr.TextStats && pw == nil && r.Err == nil {
+		r.Text = textStatsOf(r.Data)
+		if tc != nil {
+			r.Text = tc.stats()
+		}
+	}
+}
+
+// partial returns the contents read before an error if the Processor keeps
+// them, along with whether any were kept.
+func (pr *Processor) partial(data string) (string, bool) {
+	if !pr.KeepPartial || data == "" {
+		return "", false
+	}
+
+	return data, true
+}
+
+// report marks r as a duplicate if its hash was already added to seen,
+// calls the Processor's callbacks with r, records any error of OnResult in
+// r, logs any error, and adds r to the metrics. Results marked as empty are
+// not passed to OnResult.
+func (pr *Processor) report(ctx context.Context, r *Result, seen *hashSet) {
+	if r.Err == nil && r.Hash != "" {
+		r.Duplicate = !seen.add(r.Hash)
+	}
+
+	if pr.OnResult != nil && !r.skip {
+		if err := pr.OnResult(ctx, *r); err != nil && r.Err == nil {
+			r.Err = err
+		}
+	}
+
+	if r.Err != nil {
+		pr.logf("%s %v", r.Path, r.Err)
+
+		if pr.OnError != nil {
+			pr.OnError(r.Path, r.Err)
+		}
+	}
+
+	pr.Metrics.add(*r)
+}
+
+// logf prints to the Processor's logger. A nil logger results in a no-op.
+func (pr *Processor) logf(format string, v ...any) {
+	if pr.Logger != nil {
+		pr.Logger.Printf(format, v...)
+	}
+}
+
+// Funnel receives a Source, submits its files (with the options of an
+// OptionsSource, and up to the Processor's count) to a WorkerPool, and
+// returns a channel of results (ordered and with empty files skipped, as
+// set by the Processor) which is closed once all files have been
+// processed. The source is no longer read once the count is reached. The
+// returned error channel receives a single error: ErrCanceled if processing
+// is canceled before all files are sent out, or the error of the source if
+// it ends early. Source errors are always received before the results
+// channel is closed.
+//
+// Digesters block until their results are received, so a consumer which
+// stops receiving early (e.g. on a panic) must cancel ctx for them to
+// return. Results already sent out can then be drained until the channel
+// is closed, which releases their memory and closes their streams.
+func (pr *Processor) Funnel(ctx context.Context, src Source) (<-chan Result, <-chan error) {
+	errc := make(chan error, 1)
+
+	var ow *orderedWriter
+	if pr.Ordered {
+		ow = newOrderedWriter(pr.OrderBuffer)
+	}
+
+	wp := newWorkerPool(ctx, pr, ow)
+	osrc, _ := src.(OptionsSource)
+
+	// anon go func sends tasks down the correct channel.
+	go func() {
+		defer func() {
+			_ = wp.Shutdown(context.Background())
+		}()
+
+		for n := 0; pr.Count <= 0 || n < pr.Count; n++ {
+			t, ok, err := next(ctx, src, osrc)
+			if err == nil && !ok {
+				break
+			}
+
+			if err == nil {
+				err = wp.submit(t.path, t.size, t.opts)
+			}
+
+			if err != nil {
+				pr.logf("processing canceled: %v", err)
+
+				// report cancellation once, and never block on it.
+				select {
+				case errc <- ErrCanceled:
+				default:
+				}
+				return
+			}
+		}
+
+		if err := src.Err(); err != nil {
+			pr.logf("source ended early: %v", err)
+
+			select {
+			case errc <- err:
+			default:
+			}
+		}
+	}()
+
+	rs := wp.Results()
+	if ow != nil {
+		rs = ow.order(ctx, rs)
+	}
+
+	if pr.SkipEmpty {
+		rs = skipEmpty(ctx, rs)
+	}
+
+	return rs, errc
+}
+
+// next returns the next path of src (with its size, and options if osrc is
+// not nil) as an unindexed task, or the error of ctx if it is done first.
+// Next is called separately so that a source which is blocked (e.g. on
+// stdin) does not hold up cancellation, in which case its value is dropped
+// once returned and src is not used again.
+func next(ctx context.Context, src Source, osrc OptionsSource) (task, bool, error) {
+	type value struct {
+		t  task
+		ok bool
+	}
+	c := make(chan value, 1)
+
+	go func() {
+		var v value
+		v.t.path, v.t.size, v.ok = src.Next()
+		if v.ok && osrc != nil {
+			v.t.opts = osrc.Options()
+		}
+		c <- v
+	}()
+
+	select {
+	case v := <-c:
+		return v.t, v.ok, nil
+	case <-ctx.Done():
+		return task{}, false, ctx.Err()
+	}
+}
+
+// skipEmpty receives results and sends them out, except for those which
+// were marked as empty by a digester.
+func skipEmpty(ctx context.Context, rs <-chan Result) <-chan Result {
+	c := make(chan Result)
+
+	go func() {
+		defer close(c)
+
+		for r := range rs {
+			if r.skip {
+				r.Release()
+				continue
+			}
+
+			select {
+			case c <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c
+}
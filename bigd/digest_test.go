@@ -0,0 +1,450 @@
+package bigd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/daved/groupthink-bigd/bigd/bigdtest"
+)
+
+// gzipped returns the provided contents compressed as a gzip member.
+func gzipped(t testing.TB, s string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	gzw := gzip.NewWriter(&buf)
+	if _, err := gzw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// gzipFS returns a filesystem holding n gzip files named like those in
+// testdata (e.g. "file0000.gz"), each holding its own name.
+func gzipFS(t testing.TB, n int) fstest.MapFS {
+	t.Helper()
+
+	fsys := fstest.MapFS{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%04d.gz", i)
+		fsys[name] = &fstest.MapFile{Data: gzipped(t, name)}
+	}
+
+	return fsys
+}
+
+// faultFS wraps a filesystem so that chosen files fail to open, or fail to
+// be read once some of their bytes are read.
+type faultFS struct {
+	fs.FS
+	open  map[string]error
+	read  map[string]error
+	after int
+}
+
+// Open implements fs.FS.
+func (f faultFS) Open(name string) (fs.File, error) {
+	if err := f.open[name]; err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	file, err := f.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.read[name]; err != nil {
+		return &faultFile{File: file, left: f.after, err: err}, nil
+	}
+
+	return file, nil
+}
+
+// faultFile fails to be read with err once left bytes are read.
+type faultFile struct {
+	fs.File
+	left int
+	err  error
+}
+
+// Read implements fs.File.
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, f.err
+	}
+
+	if len(p) > f.left {
+		p = p[:f.left]
+	}
+
+	n, err := f.File.Read(p)
+	f.left -= n
+
+	return n, err
+}
+
+// funnelDir processes the files within dir of the Processor's filesystem,
+// and returns the channels of Funnel.
+func funnelDir(ctx context.Context, t *testing.T, pr *Processor, dir string) (<-chan Result, <-chan error) {
+	t.Helper()
+
+	if err := pr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsi, err := pr.FilesInfoIn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pr.Funnel(ctx, fsi.Source())
+}
+
+// collect processes the provided paths, and returns the results in the
+// order they are received.
+func collect(t *testing.T, pr *Processor, paths ...string) []Result {
+	t.Helper()
+
+	if err := pr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rs, errc := pr.Funnel(ctx, NewPathSource(paths...))
+
+	var got []Result
+	for r := range rs {
+		r.Release()
+		got = append(got, r)
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("got error %v, want none", err)
+	default:
+	}
+
+	return got
+}
+
+// waitGoroutines fails the test unless the amount of goroutines returns to
+// base within a few seconds, since goroutines which were unblocked may not
+// have returned yet.
+func waitGoroutines(t *testing.T, base int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= base {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("got %d goroutines, want %d; stacks:\n%s", n, base, buf)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFunnelCanceledDoesNotLeak(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	pr := NewProcessor()
+	pr.FS = gzipFS(t, 200)
+	pr.Width = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rs, errc := funnelDir(ctx, t, pr, ".")
+
+	// Cancel once a few results are received, while most files are yet to
+	// be submitted, then drain as a consumer should.
+	var n int
+	for r := range rs {
+		r.Release()
+
+		n++
+		if n == 3 {
+			cancel()
+		}
+	}
+
+	if n >= 200 {
+		t.Fatalf("got all %d results, want processing canceled", n)
+	}
+
+	select {
+	case err := <-errc:
+		if err != ErrCanceled {
+			t.Fatalf("got error %v, want %v", err, ErrCanceled)
+		}
+	default:
+		t.Fatal("got no error, want cancellation reported")
+	}
+
+	waitGoroutines(t, base)
+}
+
+func TestFunnelAbandonedDoesNotLeak(t *testing.T) {
+	tests := []struct {
+		name      string
+		streaming bool
+	}{
+		{"buffered", false},
+		{"streaming", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := runtime.NumGoroutine()
+
+			// A bad file early on stops the consumer, as main once did by
+			// exiting on the first error, while digesters hold further
+			// results (and open streams) waiting to be received.
+			fsys := gzipFS(t, 100)
+			fsys["file0002.gz"] = &fstest.MapFile{Data: []byte("not gzip")}
+
+			pr := NewProcessor()
+			pr.FS = fsys
+			pr.Width = 4
+			pr.Ordered = true
+			pr.Streaming = tt.streaming
+
+			ctx, cancel := context.WithCancel(context.Background())
+			rs, _ := funnelDir(ctx, t, pr, ".")
+
+			var failed bool
+			for r := range rs {
+				if r.Err == nil && r.Stream != nil {
+					_, err := io.Copy(io.Discard, r.Stream)
+					_ = r.Stream.Close()
+					r.Err = err
+				}
+
+				if r.Err != nil {
+					failed = true
+					break
+				}
+			}
+
+			if !failed {
+				t.Fatal("got no error, want the bad file to fail")
+			}
+
+			// Abandon the results without draining them.
+			cancel()
+
+			waitGoroutines(t, base)
+		})
+	}
+}
+
+func TestDigestMultistream(t *testing.T) {
+	const p = "../testdata/multistream/members.gz"
+
+	tests := []struct {
+		name   string
+		single bool
+		want   string
+	}{
+		{"all members", false, "This is member #1.\nThis is member #2.\n"},
+		{"single member", true, "This is member #1.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.Single = tt.single
+
+			rs := collect(t, pr, p)
+			if len(rs) != 1 {
+				t.Fatalf("got %d results, want 1", len(rs))
+			}
+
+			r := rs[0]
+			if r.Err != nil {
+				t.Fatalf("got error %v, want none", r.Err)
+			}
+			if r.Data != tt.want {
+				t.Fatalf("got data %q, want %q", r.Data, tt.want)
+			}
+			if r.DataSize != int64(len(tt.want)) {
+				t.Fatalf("got data size %d, want %d", r.DataSize, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDigestErrors(t *testing.T) {
+	// A generated file is large enough to be read in several chunks, so
+	// that a read error occurs partway through decompression.
+	dir := t.TempDir()
+	ps, err := bigdtest.WriteFixtures(dir, 1, 256<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := os.ReadFile(ps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errDenied := errors.New("injected denial")
+	errRead := errors.New("injected read failure")
+
+	fsys := faultFS{
+		FS: fstest.MapFS{
+			"good.gz":    {Data: gzipped(t, "good")},
+			"denied.gz":  {Data: gzipped(t, "denied")},
+			"magic.gz":   {Data: []byte("plain text, not gzip")},
+			"header.gz":  {Data: []byte{0x1f, 0x8b, 0x07, 0, 0, 0, 0, 0, 0, 0}},
+			"trunc.gz":   {Data: gzipped(t, "truncated contents")[:20]},
+			"midread.gz": {Data: large},
+			"unknown.xy": {Data: gzipped(t, "unknown")},
+		},
+		open:  map[string]error{"denied.gz": errDenied},
+		read:  map[string]error{"midread.gz": errRead},
+		after: len(large) / 2,
+	}
+
+	tests := []struct {
+		path  string
+		stage Stage
+		want  error
+	}{
+		{"good.gz", 0, nil},
+		{"missing.gz", StageOpen, fs.ErrNotExist},
+		{"denied.gz", StageOpen, errDenied},
+		{"magic.gz", StageInit, ErrBadMagic},
+		{"header.gz", StageInit, gzip.ErrHeader},
+		{"trunc.gz", StageRead, io.ErrUnexpectedEOF},
+		{"midread.gz", StageRead, errRead},
+		{"unknown.xy", StageInit, ErrUnknownFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.FS = fsys
+
+			rs := collect(t, pr, tt.path)
+			if len(rs) != 1 {
+				t.Fatalf("got %d results, want 1", len(rs))
+			}
+
+			r := rs[0]
+			if tt.stage == 0 {
+				if r.Err != nil {
+					t.Fatalf("got error %v, want none", r.Err)
+				}
+				return
+			}
+
+			var e *Error
+			if !errors.As(r.Err, &e) {
+				t.Fatalf("got error %v (%T), want *Error", r.Err, r.Err)
+			}
+			if e.Stage != tt.stage {
+				t.Errorf("got stage %s, want %s", e.Stage, tt.stage)
+			}
+			if e.Path != tt.path {
+				t.Errorf("got path %q, want %q", e.Path, tt.path)
+			}
+			if !errors.Is(r.Err, tt.want) {
+				t.Errorf("got error %v, want %v", r.Err, tt.want)
+			}
+			if r.Data != "" {
+				t.Errorf("got data of %d bytes, want none", len(r.Data))
+			}
+		})
+	}
+}
+
+// blockedSource returns its paths, then blocks within Next until unblocked.
+type blockedSource struct {
+	paths   []string
+	unblock chan struct{}
+}
+
+// Next implements Source.
+func (s *blockedSource) Next() (string, int64, bool) {
+	if len(s.paths) == 0 {
+		<-s.unblock
+		return "", 0, false
+	}
+
+	p := s.paths[0]
+	s.paths = s.paths[1:]
+
+	return p, 0, true
+}
+
+// Err implements Source.
+func (s *blockedSource) Err() error {
+	return nil
+}
+
+func TestFunnelCanceledWhileSourceBlocked(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	pr := NewProcessor()
+	pr.FS = gzipFS(t, 1)
+
+	src := &blockedSource{paths: []string{"file0000.gz"}, unblock: make(chan struct{})}
+
+	// The source is unblocked only once the test ends, so that the call
+	// left blocked is not counted against the goroutines of the run.
+	defer func() {
+		close(src.unblock)
+		waitGoroutines(t, base)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	rs, errc := pr.Funnel(ctx, src)
+
+	done := make(chan struct{})
+	go func() {
+		for r := range rs {
+			r.Release()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("results were not closed after cancellation")
+	}
+
+	select {
+	case err := <-errc:
+		if err != ErrCanceled {
+			t.Fatalf("got error %v, want %v", err, ErrCanceled)
+		}
+	default:
+		t.Fatal("got no error, want cancellation reported")
+	}
+}
@@ -0,0 +1,248 @@
+package bigd
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Filter holds the criteria which files must meet to be collected.
+type Filter struct {
+	// Exts holds extensions, one of which a file name must end with. An
+	// empty Exts matches all names.
+	Exts []string
+
+	// Pattern holds a glob (as used by filepath.Match) which a file name
+	// must match. An empty pattern matches all names.
+	Pattern string
+
+	// Since and Until bound the modification times of files, inclusively.
+	// A zero time leaves the relevant bound open.
+	Since time.Time
+	Until time.Time
+
+	// MinSize and MaxSize bound the compressed sizes of files in bytes,
+	// inclusively. A size of 0 leaves the relevant bound open.
+	MinSize int64
+	MaxSize int64
+}
+
+// match reports whether the provided file meets the criteria of the filter.
+func (f Filter) match(fi os.FileInfo) bool {
+	if len(f.Exts) > 0 && !hasExt(fi.Name(), f.Exts) {
+		return false
+	}
+
+	if f.Pattern != "" {
+		if ok, _ := filepath.Match(f.Pattern, fi.Name()); !ok {
+			return false
+		}
+	}
+
+	if !f.Since.IsZero() && fi.ModTime().Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && fi.ModTime().After(f.Until) {
+		return false
+	}
+
+	if fi.Size() < f.MinSize || (f.MaxSize > 0 && fi.Size() > f.MaxSize) {
+		return false
+	}
+
+	return true
+}
+
+// sorts maps the supported sort names to functions which report whether
+// file a is ordered before file b.
+var sorts = map[string]func(a, b FileInfo) bool{
+	"name": func(a, b FileInfo) bool {
+		return a.Path() < b.Path()
+	},
+	"size": func(a, b FileInfo) bool {
+		return a.Size() < b.Size()
+	},
+	"mtime": func(a, b FileInfo) bool {
+		return a.ModTime().Before(b.ModTime())
+	},
+}
+
+// FilesInfoIn grabs all files matched by the Processor's filter within the
+// provided directory down to the Processor's depth. Files are ordered by
+// name within each directory, with the files of a subdirectory in place of
+// the subdirectory, unless the Processor's sort is set. Unreadable
+// subdirectories are skipped unless the Processor is strict.
+func (pr *Processor) FilesInfoIn(dir string) (*FilesInfo, error) {
+	var parents []os.FileInfo
+	if pr.Follow {
+		fi, err := fs.Stat(pr.fsys(), dir)
+		if err != nil {
+			return nil, err
+		}
+
+		parents = []os.FileInfo{fi}
+	}
+
+	var skipped *[]error
+	if !pr.Strict {
+		skipped = new([]error)
+	}
+
+	fsi, err := filesIn(pr.fsys(), dir, pr.Depth, pr.Filter, parents, skipped)
+	if err != nil {
+		return nil, err
+	}
+
+	if less, ok := sorts[pr.Sort]; ok {
+		sort.SliceStable(fsi, func(i, j int) bool {
+			return less(fsi[i], fsi[j])
+		})
+	}
+
+	info := &FilesInfo{Dir: dir, Files: fsi}
+	if skipped != nil {
+		info.Skipped = *skipped
+	}
+
+	return info, nil
+}
+
+// FilesInfoInEach calls FilesInfoIn for each of the provided directories
+// concurrently, which helps when directories are spread across devices.
+// The returned FilesInfo are in the order of dirs, and the error of the
+// first failing directory (in that order) is returned.
+func (pr *Processor) FilesInfoInEach(dirs []string) ([]*FilesInfo, error) {
+	fsis := make([]*FilesInfo, len(dirs))
+	errs := make([]error, len(dirs))
+
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			fsis[i], errs[i] = pr.FilesInfoIn(dir)
+		}(i, dir)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fsis, nil
+}
+
+// filesIn collects the matching files within the provided directory of
+// fsys (see walkFiles).
+func filesIn(fsys fs.FS, dir string, depth int, flt Filter, parents []os.FileInfo, skipped *[]error) ([]FileInfo, error) {
+	var fis []FileInfo
+
+	err := walkFiles(fsys, dir, depth, flt, parents, skipped, func(fi FileInfo) error {
+		fis = append(fis, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fis, nil
+}
+
+// walkFiles calls visit with the matching files within the provided
+// directory of fsys in name order (as returned by fs.ReadDir), and descends
+// into subdirectories while depth remains. Skipped entries do not disturb
+// the order of those remaining. Symbolic links are skipped unless parents
+// is set, in which case they are followed. Parents holds the directories
+// descended through, so that links back to any of them are skipped rather
+// than looping. If skipped is not nil, subdirectories which cannot be read
+// due to their permissions are skipped, and their errors are added to it.
+// An error returned by visit stops the walk and is returned.
+func walkFiles(fsys fs.FS, dir string, depth int, flt Filter, parents []os.FileInfo, skipped *[]error, visit func(FileInfo) error) error {
+	des, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if parents == nil {
+				continue
+			}
+
+			// Skip broken links, since their targets cannot be collected.
+			if fi, err = fs.Stat(fsys, path.Join(dir, fi.Name())); err != nil {
+				continue
+			}
+		}
+
+		if fi.IsDir() {
+			if depth <= 1 || isParent(fi, parents) {
+				continue
+			}
+
+			var subParents []os.FileInfo
+			if parents != nil {
+				subParents = append(parents[:len(parents):len(parents)], fi)
+			}
+
+			err := walkFiles(fsys, path.Join(dir, fi.Name()), depth-1, flt, subParents, skipped, visit)
+			if err != nil {
+				if skipped == nil || !errors.Is(err, fs.ErrPermission) {
+					return err
+				}
+
+				*skipped = append(*skipped, err)
+			}
+			continue
+		}
+
+		// Skip files which do not match the filter.
+		if !flt.match(fi) {
+			continue
+		}
+
+		if err := visit(FileInfo{FileInfo: fi, Dir: dir}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isParent reports whether the provided directory is the same as any of the
+// provided parents.
+func isParent(fi os.FileInfo, parents []os.FileInfo) bool {
+	for _, p := range parents {
+		if os.SameFile(fi, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasExt reports whether the provided name ends with any of the provided
+// extensions.
+func hasExt(name string, exts []string) bool {
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
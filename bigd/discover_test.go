@@ -0,0 +1,118 @@
+package bigd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// discoverFS returns a filesystem whose files differ in size and
+// modification time, with ties in each, along with a file which does not
+// match the default filter and files within subdirectories.
+func discoverFS() fstest.MapFS {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	return fstest.MapFS{
+		"a.gz":    {Data: []byte("aa"), ModTime: t0.Add(2 * time.Hour)},
+		"b.gz":    {Data: []byte("bb"), ModTime: t0.Add(time.Hour)},
+		"b.txt":   {Data: []byte("not collected"), ModTime: t0},
+		"b/x.gz":  {Data: []byte("xxxx"), ModTime: t0.Add(3 * time.Hour)},
+		"c.gz":    {Data: []byte("ccc"), ModTime: t0.Add(time.Hour)},
+		"cc/y.gz": {Data: []byte("yyyyy"), ModTime: t0},
+		"e.gz":    {Data: []byte("e"), ModTime: t0},
+	}
+}
+
+func TestFilesInfoIn(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		sort  string
+		want  []string
+	}{
+		{"unsorted", 1, "", []string{"a.gz", "b.gz", "c.gz", "e.gz"}},
+		{"unsorted subdirectories", 2, "", []string{"a.gz", "b/x.gz", "b.gz", "c.gz", "cc/y.gz", "e.gz"}},
+		{"name", 1, "name", []string{"a.gz", "b.gz", "c.gz", "e.gz"}},
+		{"name subdirectories", 2, "name", []string{"a.gz", "b.gz", "b/x.gz", "c.gz", "cc/y.gz", "e.gz"}},
+		{"size", 1, "size", []string{"e.gz", "a.gz", "b.gz", "c.gz"}},
+		{"size subdirectories", 2, "size", []string{"e.gz", "a.gz", "b.gz", "c.gz", "b/x.gz", "cc/y.gz"}},
+		{"mtime", 1, "mtime", []string{"e.gz", "b.gz", "c.gz", "a.gz"}},
+		{"mtime subdirectories", 2, "mtime", []string{"cc/y.gz", "e.gz", "b.gz", "c.gz", "a.gz", "b/x.gz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.FS = discoverFS()
+			pr.Depth = tt.depth
+			pr.Sort = tt.sort
+
+			if err := pr.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			fsi, err := pr.FilesInfoIn(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, fi := range fsi.Files {
+				got = append(got, fi.Path())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilesInfoInTies(t *testing.T) {
+	// Enough files are tied that an unstable sort would be likely to
+	// reorder them.
+	const n = 64
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	fsys := fstest.MapFS{}
+	var odd, even []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%04d.gz", i)
+		fsys[name] = &fstest.MapFile{
+			Data:    make([]byte, 1+i%2),
+			ModTime: t0.Add(time.Duration(i%2) * time.Hour),
+		}
+
+		if i%2 == 0 {
+			even = append(even, name)
+		} else {
+			odd = append(odd, name)
+		}
+	}
+	want := append(even, odd...)
+
+	for _, key := range []string{"size", "mtime"} {
+		t.Run(key, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.FS = fsys
+			pr.Sort = key
+
+			fsi, err := pr.FilesInfoIn(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, fi := range fsi.Files {
+				got = append(got, fi.Path())
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
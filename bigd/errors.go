@@ -0,0 +1,50 @@
+package bigd
+
+// Stage identifies the stage of processing at which an error occurred.
+type Stage int
+
+// Stage constants.
+const (
+	// StageOpen is the opening of a file.
+	StageOpen Stage = iota + 1
+
+	// StageInit is the detection of the compression format and the setup of
+	// the relevant decompressor.
+	StageInit
+
+	// StageRead is the reading of decompressed contents.
+	StageRead
+)
+
+// String implements fmt.Stringer.
+func (s Stage) String() string {
+	switch s {
+	case StageOpen:
+		return "open"
+	case StageInit:
+		return "init"
+	case StageRead:
+		return "read"
+	default:
+		return "unknown"
+	}
+}
+
+// Error is set as a result error when processing a file fails. The stage
+// of processing can be checked using errors.As, and the underlying error
+// (e.g. ErrUnknownFormat or fs.ErrNotExist) using errors.Is.
+type Error struct {
+	Stage Stage
+	Path  string
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Stage.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,320 @@
+package bigd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	// registryMu guards exts, decompressors, signatures, and headerChecks.
+	registryMu sync.RWMutex
+
+	// exts holds the file extensions of the registered compression formats
+	// in order of registration.
+	exts []string
+
+	// decompressors maps the registered file extensions to functions which
+	// wrap a reader with the relevant decompressor.
+	decompressors = map[string]Decompressor{}
+
+	// signatures holds the magic bytes of the registered compression formats
+	// along with the relevant extension.
+	signatures []signature
+
+	// headerChecks maps extensions to functions which report whether the
+	// provided leading bytes form a valid header of the relevant format. A
+	// check takes the place of the signatures of a format whose valid
+	// headers are too many to list (e.g. zlib) when its files are selected
+	// by extension. A check is dropped once its extension is registered
+	// again.
+	headerChecks = map[string]func([]byte) bool{}
+
+	// zstdDecoders holds idle zstd decoders for reuse. Each decoder retains
+	// its window and history buffers (several MB for typical frames), so
+	// reuse avoids reallocating them per file at the cost of keeping up to
+	// "width" decoders alive while digesters are busy. Idle decoders may be
+	// released by the garbage collector.
+	zstdDecoders sync.Pool
+
+	// hashes maps the supported hash names to their constructors.
+	hashes = map[string]func() hash.Hash{
+		"sha256": sha256.New,
+		"sha1":   sha1.New,
+		"md5":    md5.New,
+	}
+)
+
+// magicShown is the amount of leading bytes held by errors wrapping
+// ErrBadMagic.
+const magicShown = 8
+
+func init() {
+	Register(".gz", newGzipReader, []byte{0x1f, 0x8b})
+	Register(".zz", zlib.NewReader,
+		[]byte{0x78, 0x01}, []byte{0x78, 0x5e},
+		[]byte{0x78, 0x9c}, []byte{0x78, 0xda})
+	headerChecks[".zz"] = isZlibHeader
+	Register(".bz2", newBzip2Reader, []byte("BZh"))
+	Register(".zst", newZstdReader, []byte{0x28, 0xb5, 0x2f, 0xfd})
+	Register(".lz4", newLz4Reader, []byte{0x04, 0x22, 0x4d, 0x18})
+	Register(".xz", newXzReader, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00})
+	Register(".tgz", newGzipReader, []byte{0x1f, 0x8b})
+}
+
+// Decompressor wraps a reader with a decompressor for a compression format.
+type Decompressor func(io.Reader) (io.ReadCloser, error)
+
+// Register makes a decompressor available for files ending with ext, and
+// for files starting with any of the provided magic signatures when
+// Processor.Magic is set. Files selected by ext must otherwise start with
+// one of the signatures (if any). Registering an extension again replaces
+// its decompressor and signatures. Registered extensions are included in the
+// default filter of processors created afterwards. Register panics if ext
+// is empty or fn is nil.
+func Register(ext string, fn Decompressor, magic ...[]byte) {
+	if ext == "" || fn == nil {
+		panic("bigd: Register requires an extension and decompressor")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := decompressors[ext]; !ok {
+		exts = append(exts, ext)
+	}
+	decompressors[ext] = fn
+	delete(headerChecks, ext)
+
+	sigs := signatures[:0:0]
+	for _, sig := range signatures {
+		if sig.ext != ext {
+			sigs = append(sigs, sig)
+		}
+	}
+	for _, m := range magic {
+		sigs = append(sigs, signature{magic: append([]byte(nil), m...), ext: ext})
+	}
+	signatures = sigs
+}
+
+// isZlibHeader reports whether head starts with a valid zlib header, as
+// defined by RFC 1950: the deflate method, a window of at most 32KB, and a
+// check of the first two bytes. Only the most common headers are registered
+// as signatures, since this admits too many to be told from other data.
+func isZlibHeader(head []byte) bool {
+	if len(head) < 2 {
+		return false
+	}
+
+	cmf, flg := head[0], head[1]
+
+	return cmf&0x0f == 8 && cmf>>4 <= 7 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
+
+// signature holds the magic bytes which identify a compression format
+// along with the extension of that format.
+type signature struct {
+	magic []byte
+	ext   string
+}
+
+// Extensions returns the file extensions of the registered compression
+// formats.
+func Extensions() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return append([]string(nil), exts...)
+}
+
+// NewHash returns a new hash.Hash for the named hash. Supported names are
+// "sha256", "sha1", and "md5".
+func NewHash(name string) (hash.Hash, error) {
+	fn, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q", name)
+	}
+
+	return fn(), nil
+}
+
+// newDecompressor returns a reader which decompresses the contents of r
+// using the compression format indicated by the provided extension.
+func newDecompressor(ext string, r io.Reader) (io.ReadCloser, error) {
+	registryMu.RLock()
+	fn, ok := decompressors[ext]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+
+	return fn(r)
+}
+
+// formatExt returns the extension of the compression format used by the
+// file located at p. If magic is set, the leading bytes of br are peeked at
+// (and left unconsumed) to determine the format instead.
+func formatExt(p string, br *bufio.Reader, magic bool) (string, error) {
+	if !magic {
+		return path.Ext(p), nil
+	}
+
+	registryMu.RLock()
+	sigs := signatures
+	registryMu.RUnlock()
+
+	n := 0
+	for _, sig := range sigs {
+		if len(sig.magic) > n {
+			n = len(sig.magic)
+		}
+	}
+
+	head, err := br.Peek(n)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	for _, sig := range sigs {
+		if bytes.HasPrefix(head, sig.magic) {
+			return sig.ext, nil
+		}
+	}
+
+	return "", ErrUnknownFormat
+}
+
+// checkMagic returns an error wrapping ErrBadMagic (and holding the leading
+// bytes seen) if the leading bytes of br match none of the signatures of the
+// compression format indicated by ext (or fail its header check), so that
+// misnamed files are reported clearly rather than by a failing
+// decompressor. Formats without signatures are not checked, and empty files
+// are left to fail as usual.
+func checkMagic(ext string, br *bufio.Reader) error {
+	registryMu.RLock()
+	sigs := signatures
+	valid := headerChecks[ext]
+	registryMu.RUnlock()
+
+	head, err := br.Peek(magicShown)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if len(head) == 0 {
+		return nil
+	}
+
+	if valid != nil {
+		if valid(head) {
+			return nil
+		}
+
+		return fmt.Errorf("not a %s file (%w): % x", ext, ErrBadMagic, head)
+	}
+
+	known := false
+	for _, sig := range sigs {
+		if sig.ext != ext {
+			continue
+		}
+
+		if bytes.HasPrefix(head, sig.magic) {
+			return nil
+		}
+		known = true
+	}
+
+	if !known {
+		return nil
+	}
+
+	return fmt.Errorf("not a %s file (%w): % x", ext, ErrBadMagic, head)
+}
+
+// newGzipReader wraps gzip.NewReader so that it satisfies the decompressors
+// map value type.
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return gzr, nil
+}
+
+// newBzip2Reader wraps bzip2.NewReader with a no-op Close so that it
+// satisfies the decompressors map value type.
+func newBzip2Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(r)), nil
+}
+
+// newLz4Reader wraps lz4.NewReader with a no-op Close so that it satisfies
+// the decompressors map value type.
+func newLz4Reader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
+
+// newXzReader wraps xz.NewReader with a no-op Close so that it satisfies
+// the decompressors map value type. Each reader allocates a dictionary
+// sized by the stream header (up to 64MB for the highest presets), so up
+// to "width" dictionaries may be alive at once.
+func newXzReader(r io.Reader) (io.ReadCloser, error) {
+	xzr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(xzr), nil
+}
+
+// zstdReader wraps a zstd decoder so that closing it returns the decoder to
+// the pool for reuse.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+// Close releases the underlying reader and returns the decoder to the pool.
+func (z zstdReader) Close() error {
+	_ = z.Decoder.Reset(nil)
+	zstdDecoders.Put(z.Decoder)
+
+	return nil
+}
+
+// newZstdReader returns a pooled zstd decoder reading from r. Decoders are
+// limited to a concurrency of 1 so that no goroutines are left running
+// while they sit idle in the pool.
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	if d, ok := zstdDecoders.Get().(*zstd.Decoder); ok {
+		if err := d.Reset(r); err != nil {
+			d.Close()
+			return nil, err
+		}
+
+		return zstdReader{d}, nil
+	}
+
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return zstdReader{d}, nil
+}
@@ -0,0 +1,77 @@
+package bigd
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"testing"
+	"testing/fstest"
+)
+
+// zlibbed returns the provided contents compressed as a zlib stream led by
+// the provided header, which zlib writers do not all produce.
+func zlibbed(t *testing.T, cmf, flg byte, s string) []byte {
+	t.Helper()
+
+	buf := bytes.NewBuffer([]byte{cmf, flg})
+
+	fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, adler32.Checksum([]byte(s))); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestZlibHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmf, flg byte
+		want     error
+	}{
+		{"default", 0x78, 0x9c, nil},
+		{"best", 0x78, 0xda, nil},
+		{"8KB window", 0x58, 0x85, nil},
+		{"16KB window", 0x68, 0x81, nil},
+		{"256B window", 0x08, 0x1d, nil},
+		{"bad check", 0x78, 0x9d, ErrBadMagic},
+		{"bad method", 0x79, 0x9c, ErrBadMagic},
+		{"bad window", 0x88, 0x1c, ErrBadMagic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.FS = fstest.MapFS{"file.zz": {Data: zlibbed(t, tt.cmf, tt.flg, "Hello, zlib!")}}
+
+			rs := collect(t, pr, "file.zz")
+			if len(rs) != 1 {
+				t.Fatalf("got %d results, want 1", len(rs))
+			}
+
+			r := rs[0]
+			if tt.want != nil {
+				if !errors.Is(r.Err, tt.want) {
+					t.Fatalf("got error %v, want %v", r.Err, tt.want)
+				}
+				return
+			}
+
+			if r.Err != nil || r.Data != "Hello, zlib!" {
+				t.Fatalf("got data %q, error %v", r.Data, r.Err)
+			}
+		})
+	}
+}
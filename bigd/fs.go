@@ -0,0 +1,36 @@
+package bigd
+
+import (
+	"io/fs"
+	"os"
+)
+
+// osFS implements fs.FS using the os package. Unlike os.DirFS, paths are
+// not restricted to those valid for fs.FS, so that relative paths (e.g.
+// "./testdata/") and absolute paths work as usual.
+type osFS struct{}
+
+// Open implements fs.FS.
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// Stat implements fs.StatFS.
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// fsys returns the filesystem set on the Processor, or the operating
+// system's filesystem if none is set.
+func (pr *Processor) fsys() fs.FS {
+	if pr.FS == nil {
+		return osFS{}
+	}
+
+	return pr.FS
+}
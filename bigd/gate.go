@@ -0,0 +1,75 @@
+package bigd
+
+import (
+	"context"
+	"sync"
+)
+
+// Gate pauses digesters between files. Digesters finish the file they are
+// processing, and then wait until the gate is resumed before starting
+// another. A Gate is safe for concurrent use.
+type Gate struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+// NewGate returns an open Gate.
+func NewGate() *Gate {
+	return &Gate{}
+}
+
+// Pause closes the gate, so that digesters wait once their current files
+// are processed. Pausing a paused gate is harmless.
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		g.paused = true
+		g.resume = make(chan struct{})
+	}
+}
+
+// Resume opens the gate, and releases waiting digesters. Resuming an open
+// gate is harmless.
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		g.paused = false
+		close(g.resume)
+	}
+}
+
+// Paused reports whether the gate is paused.
+func (g *Gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.paused
+}
+
+// wait blocks while the gate is paused, and returns false if ctx is done
+// first. A nil gate is always open.
+func (g *Gate) wait(ctx context.Context) bool {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	paused, resume := g.paused, g.resume
+	g.mu.Unlock()
+
+	if !paused {
+		return true
+	}
+
+	select {
+	case <-resume:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,56 @@
+package bigd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// grepReader reads only the lines of its source which match re, each with
+// its trailing newline (if any). Lines are matched without their newline,
+// and are read whole however long they are.
+type grepReader struct {
+	re   *regexp.Regexp
+	br   *bufio.Reader
+	line []byte
+	left []byte // rest of the matching line not yet read
+	err  error
+}
+
+// newGrepReader returns a reader of the lines of r which match re.
+func newGrepReader(r io.Reader, re *regexp.Regexp) *grepReader {
+	return &grepReader{re: re, br: bufio.NewReader(r)}
+}
+
+// Read implements io.Reader.
+func (g *grepReader) Read(p []byte) (int, error) {
+	for len(g.left) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+
+		g.line, g.err = g.readLine(g.line[:0])
+		if len(g.line) > 0 && g.re.Match(bytes.TrimSuffix(g.line, []byte{'\n'})) {
+			g.left = g.line
+		}
+	}
+
+	n := copy(p, g.left)
+	g.left = g.left[n:]
+
+	return n, nil
+}
+
+// readLine appends the next line (including its newline) to buf. Lines
+// longer than the buffer of the bufio.Reader are gathered in parts.
+func (g *grepReader) readLine(buf []byte) ([]byte, error) {
+	for {
+		part, err := g.br.ReadSlice('\n')
+		buf = append(buf, part...)
+
+		if err != bufio.ErrBufferFull {
+			return buf, err
+		}
+	}
+}
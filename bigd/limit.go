@@ -0,0 +1,41 @@
+package bigd
+
+import "context"
+
+// openLimit is a semaphore which limits the amount of files held open at
+// once, regardless of width.
+type openLimit chan struct{}
+
+// newOpenLimit returns a limit of n open files. An n of 0 or less results
+// in a nil limit, which is a no-op.
+func newOpenLimit(n int) openLimit {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(openLimit, n)
+}
+
+// acquire blocks until a further file may be held open. False is returned
+// if ctx is done first, in which case nothing is held.
+func (l openLimit) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release gives back a file acquired from the limit.
+func (l openLimit) release() {
+	if l == nil {
+		return
+	}
+
+	<-l
+}
@@ -0,0 +1,75 @@
+package bigd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ManifestEntry is a single entry of a manifest (see NewManifestSource).
+type ManifestEntry struct {
+	Path         string `json:"path"`
+	Format       string `json:"format,omitempty"`
+	ExpectedHash string `json:"expected_hash,omitempty"`
+}
+
+// manifestSource provides the files listed by a manifest along with their
+// options.
+type manifestSource struct {
+	dec  *json.Decoder
+	n    int
+	opts Options
+	err  error
+}
+
+// NewManifestSource returns an OptionsSource which provides the files listed
+// by a manifest read from r, holding a ManifestEntry per line (JSON lines).
+// Formats may be given with or without the leading dot (e.g. "zst"). An
+// entry which cannot be decoded, holds unknown fields, or lacks a path ends
+// the source early. Paths are not validated until they are processed, so
+// missing files are reported as result errors.
+func NewManifestSource(r io.Reader) OptionsSource {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	return &manifestSource{dec: dec}
+}
+
+// Next implements Source.
+func (s *manifestSource) Next() (string, int64, bool) {
+	if s.err != nil {
+		return "", 0, false
+	}
+
+	var e ManifestEntry
+	if err := s.dec.Decode(&e); err != nil {
+		if err != io.EOF {
+			s.err = fmt.Errorf("manifest entry %d: %v", s.n+1, err)
+		}
+		return "", 0, false
+	}
+	s.n++
+
+	if e.Path == "" {
+		s.err = fmt.Errorf("manifest entry %d: missing path", s.n)
+		return "", 0, false
+	}
+
+	s.opts = Options{Format: e.Format, Hash: e.ExpectedHash}
+	if s.opts.Format != "" && !strings.HasPrefix(s.opts.Format, ".") {
+		s.opts.Format = "." + s.opts.Format
+	}
+
+	return e.Path, 0, true
+}
+
+// Err implements Source.
+func (s *manifestSource) Err() error {
+	return s.err
+}
+
+// Options implements OptionsSource.
+func (s *manifestSource) Options() Options {
+	return s.opts
+}
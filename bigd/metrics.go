@@ -0,0 +1,82 @@
+package bigd
+
+import (
+	"expvar"
+	"io"
+)
+
+// Metrics holds counters which are updated while processing. The counters
+// are safe for concurrent use, and may be read at any time.
+type Metrics struct {
+	// Files counts the results sent (or, when streaming, finished).
+	Files expvar.Int
+
+	// BytesIn counts compressed bytes.
+	BytesIn expvar.Int
+
+	// BytesOut counts decompressed bytes.
+	BytesOut expvar.Int
+
+	// Errors counts the results with errors.
+	Errors expvar.Int
+
+	// Active counts the digesters currently processing a file.
+	Active expvar.Int
+}
+
+// PublishMetrics returns a new Metrics which is published through expvar as
+// a map with the provided name, so that the counters are served at
+// "/debug/vars" if the host serves the expvar handler. Like expvar.Publish,
+// it panics if the name is already in use.
+func PublishMetrics(name string) *Metrics {
+	m := &Metrics{}
+
+	vars := expvar.NewMap(name)
+	vars.Set("files", &m.Files)
+	vars.Set("bytes_in", &m.BytesIn)
+	vars.Set("bytes_out", &m.BytesOut)
+	vars.Set("errors", &m.Errors)
+	vars.Set("active", &m.Active)
+
+	return m
+}
+
+// add includes the provided result in the counters. A nil Metrics results
+// in a no-op.
+func (m *Metrics) add(r Result) {
+	if m == nil {
+		return
+	}
+
+	m.Files.Add(1)
+	m.BytesIn.Add(r.Size)
+	m.BytesOut.Add(r.DataSize)
+
+	if r.Err != nil {
+		m.Errors.Add(1)
+	}
+}
+
+// active adds delta to the count of active digesters. A nil Metrics results
+// in a no-op.
+func (m *Metrics) active(delta int64) {
+	if m == nil {
+		return
+	}
+
+	m.Active.Add(delta)
+}
+
+// countWriter wraps a writer so that the bytes written are added to n.
+type countWriter struct {
+	w io.Writer
+	n *expvar.Int
+}
+
+// Write implements io.Writer.
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+
+	return n, err
+}
@@ -0,0 +1,133 @@
+package bigd
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Ordered receives results and sends them out in the order of their
+// indexes. Results which arrive early are held until all preceding results
+// have been sent, so only the consumer is serialized (not the digesters).
+// Results sharing an index (i.e. tar entries) are sent in the order they
+// arrive, and the next index is not sent until a result for the current
+// index reports no more to follow. Any results still held when rs is closed
+// (e.g. due to cancellation) are sent in order of their indexes.
+func Ordered(ctx context.Context, rs <-chan Result) <-chan Result {
+	return newOrderedWriter(0).order(ctx, rs)
+}
+
+// orderedWriter sends results out in the order of their indexes (see
+// Ordered), and bounds how far ahead of the next index to be sent files
+// may be started. Digesters wait on admit before starting a file, so a slow
+// file holds back newer files rather than letting held results grow
+// without bound. The file of the next index is always admitted, so waiting
+// digesters cannot stall it.
+type orderedWriter struct {
+	bound int
+
+	mu   sync.Mutex
+	next int
+	wake chan struct{}
+}
+
+// newOrderedWriter returns an orderedWriter which admits files up to bound
+// indexes ahead of the next index to be sent. A bound of 0 or less admits
+// all files.
+func newOrderedWriter(bound int) *orderedWriter {
+	return &orderedWriter{bound: bound, wake: make(chan struct{})}
+}
+
+// admit blocks until the file of index idx may be started. False is
+// returned if ctx is done first. A nil orderedWriter admits all files.
+func (w *orderedWriter) admit(ctx context.Context, idx int) bool {
+	if w == nil || w.bound <= 0 {
+		return true
+	}
+
+	for {
+		w.mu.Lock()
+		if idx < w.next+w.bound {
+			w.mu.Unlock()
+			return true
+		}
+		wake := w.wake
+		w.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// advance records that all results of the next index have been sent, and
+// wakes any digesters waiting to be admitted.
+func (w *orderedWriter) advance() {
+	w.mu.Lock()
+	w.next++
+	close(w.wake)
+	w.wake = make(chan struct{})
+	w.mu.Unlock()
+}
+
+// order receives results from rs and returns a channel which they are sent
+// out on in the order of their indexes. The returned channel is closed once
+// rs is closed and all held results are sent, or once ctx is done.
+func (w *orderedWriter) order(ctx context.Context, rs <-chan Result) <-chan Result {
+	c := make(chan Result)
+
+	go func() {
+		defer close(c)
+
+		held := make(map[int][]Result)
+
+		send := func(r Result) bool {
+			select {
+			case c <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for r := range rs {
+			held[r.Index] = append(held[r.Index], r)
+
+			for len(held[w.next]) > 0 {
+				q := held[w.next]
+				delete(held, w.next)
+
+				more := true
+				for _, hr := range q {
+					if !send(hr) {
+						return
+					}
+					more = hr.More
+				}
+
+				if more {
+					break
+				}
+				w.advance()
+			}
+		}
+
+		idxs := make([]int, 0, len(held))
+		for k := range held {
+			idxs = append(idxs, k)
+		}
+		sort.Ints(idxs)
+
+		for _, k := range idxs {
+			for _, hr := range held[k] {
+				if !send(hr) {
+					return
+				}
+			}
+		}
+	}()
+
+	return c
+}
@@ -0,0 +1,233 @@
+package bigd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrPoolShutdown is returned when submitting to a WorkerPool which has been
+// shut down.
+var ErrPoolShutdown = errors.New("worker pool shut down")
+
+// WorkerPool runs digesters (determined by the Processor's width) which
+// process submitted files, and delivers their results. Results must be
+// received until the results channel is closed so that digesters are not
+// left blocked. If the Processor is adaptive, digesters are added and
+// retired while running instead. If the Processor is deterministic, each
+// digester receives files from its own lane rather than the shared tasks.
+type WorkerPool struct {
+	ctx     context.Context
+	tasks   chan task
+	lanes   []chan task
+	results chan Result
+	quit    chan struct{}
+	done    chan struct{}
+	scale   *scaler
+
+	mu   sync.RWMutex
+	once sync.Once
+	next atomic.Int64
+}
+
+// NewWorkerPool starts a WorkerPool which uses the settings of the provided
+// Processor. Work stops early if ctx is done.
+func NewWorkerPool(ctx context.Context, pr *Processor) *WorkerPool {
+	return newWorkerPool(ctx, pr, nil)
+}
+
+// shared holds the limits and state shared by the digesters of a pool.
+// Each is a no-op if nil.
+type shared struct {
+	mem  *budget        // buffered data held by results
+	fds  openLimit      // files held open
+	rate *rate.Limiter  // files started per second
+	ow   *orderedWriter // files admitted ahead of ordered results
+	seen *hashSet       // hashes of contents already processed
+}
+
+// newWorkerPool starts a WorkerPool whose digesters wait to be admitted by
+// ow (if not nil) before starting each file.
+func newWorkerPool(ctx context.Context, pr *Processor, ow *orderedWriter) *WorkerPool {
+	width := pr.Width
+	if width < 1 {
+		width = DefaultWidth
+	}
+
+	sh := &shared{
+		mem: newBudget(pr.MemBudget),
+		fds: newOpenLimit(pr.MaxOpen),
+		ow:  ow,
+	}
+
+	if pr.Rate > 0 {
+		sh.rate = rate.NewLimiter(rate.Limit(pr.Rate), 1)
+	}
+
+	if pr.Dedup {
+		sh.seen = newHashSet()
+	}
+
+	maxWidth := pr.MaxWidth
+	if maxWidth < 1 {
+		maxWidth = width
+	}
+
+	wp := &WorkerPool{
+		ctx:     ctx,
+		tasks:   make(chan task),
+		results: make(chan Result, pr.Buffer),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		scale:   newScaler(pr.Adaptive, maxWidth),
+	}
+
+	// Results of adaptive pools are relayed so that waits on the consumer
+	// can be observed.
+	out := wp.results
+	if wp.scale != nil {
+		out = make(chan Result)
+		width = 1
+	}
+
+	var wg sync.WaitGroup
+	spawn := func(tasks <-chan task) {
+		wg.Add(1)
+		go func() {
+			pr.digest(ctx, tasks, wp.scale.retired(), out, sh)
+			wg.Done()
+		}()
+	}
+
+	// Assign files to digesters by index when deterministic, so that each
+	// digester processes the same files on every run.
+	if pr.Deterministic {
+		wp.lanes = make([]chan task, width)
+		for i := range wp.lanes {
+			wp.lanes[i] = make(chan task)
+		}
+	}
+
+	// setup digesters by width.
+	for i := 0; i < width; i++ {
+		tasks := wp.tasks
+		if wp.lanes != nil {
+			tasks = wp.lanes[i]
+		}
+
+		spawn(tasks)
+	}
+
+	// scale digesters until shut down. The scaler is counted as running so
+	// that digesters are only ever added while others are counted.
+	if wp.scale != nil {
+		wg.Add(1)
+		go func() {
+			wp.scale.run(ctx, wp.quit, func() { spawn(wp.tasks) })
+			wg.Done()
+		}()
+	}
+
+	// wait and close result channel after tasks have been processed. The
+	// relay (if any) closes the results channel once it has sent them.
+	go func() {
+		wg.Wait()
+		close(out)
+
+		if wp.scale == nil {
+			close(wp.done)
+		}
+	}()
+
+	if wp.scale != nil {
+		go func() {
+			wp.scale.relay(ctx, out, wp.results)
+			close(wp.done)
+		}()
+	}
+
+	return wp
+}
+
+// Submit queues the file located at path for processing, and blocks until a
+// digester accepts it. Results are indexed in the order files are
+// submitted. An error is returned if the pool has been shut down or its
+// context is done.
+func (wp *WorkerPool) Submit(path string) error {
+	return wp.submit(path, 0, Options{})
+}
+
+// submit queues the file located at p with the provided size (0 if
+// unknown) and options.
+func (wp *WorkerPool) submit(p string, size int64, opts Options) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	select {
+	case <-wp.quit:
+		return ErrPoolShutdown
+	default:
+	}
+
+	t := task{idx: int(wp.next.Add(1) - 1), path: p, size: size, opts: opts}
+
+	tasks := wp.tasks
+	if wp.lanes != nil {
+		tasks = wp.lanes[t.idx%len(wp.lanes)]
+	}
+
+	if wp.scale != nil {
+		select {
+		case tasks <- t:
+			return nil
+		default:
+		}
+
+		defer wp.scale.starve(time.Now())
+	}
+
+	select {
+	case tasks <- t:
+		return nil
+	case <-wp.quit:
+		return ErrPoolShutdown
+	case <-wp.ctx.Done():
+		return wp.ctx.Err()
+	}
+}
+
+// Results returns the channel of results, which is closed once the pool has
+// been shut down and all accepted files have been processed (or the pool's
+// context is done).
+func (wp *WorkerPool) Results() <-chan Result {
+	return wp.results
+}
+
+// Shutdown stops the pool from accepting files, and waits for the files
+// already accepted to be processed. If ctx is done first, its error is
+// returned and the remaining work carries on in the background. Shutdown may
+// be called more than once.
+func (wp *WorkerPool) Shutdown(ctx context.Context) error {
+	wp.once.Do(func() {
+		// Release blocked submits before waiting for them to return.
+		close(wp.quit)
+
+		wp.mu.Lock()
+		close(wp.tasks)
+		for _, lane := range wp.lanes {
+			close(lane)
+		}
+		wp.mu.Unlock()
+	})
+
+	select {
+	case <-wp.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
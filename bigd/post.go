@@ -0,0 +1,91 @@
+package bigd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// PathHeader is the HTTP header which holds the path of the processed file
+// in requests made by a Poster.
+const PathHeader = "X-Bigd-Path"
+
+// Poster posts the decompressed contents of each result to an HTTP
+// endpoint, and is intended to be used as a Processor's OnResult so that
+// posts are made with the concurrency of the digesters. Failed results and
+// duplicates (see Processor.Dedup) are not posted. Verified contents are
+// not held, so a Poster should not be used with Processor.Verify.
+type Poster struct {
+	url    string
+	client *http.Client
+	sem    chan struct{}
+}
+
+// NewPoster returns a Poster which posts to url using a shared client that
+// pools connections. Up to concurrency posts are made at once, which lets
+// the endpoint be spared while the digesters keep their width. A
+// concurrency of 0 leaves posts bounded by the width alone.
+func NewPoster(url string, concurrency int) *Poster {
+	idle := concurrency
+	if idle <= 0 {
+		idle = DefaultWidth
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = idle
+
+	p := &Poster{url: url, client: &http.Client{Transport: t}}
+	if concurrency > 0 {
+		p.sem = make(chan struct{}, concurrency)
+	}
+
+	return p
+}
+
+// Post posts the contents of r with its path held by PathHeader, and its
+// sniffed content type (if any). An error wrapping ErrPostRejected is
+// returned if the endpoint responds with a status other than 2xx.
+func (p *Poster) Post(ctx context.Context, r Result) error {
+	if r.Err != nil || r.Duplicate {
+		return nil
+	}
+
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+			defer func() { <-p.sem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, strings.NewReader(r.Data))
+	if err != nil {
+		return err
+	}
+
+	typ := r.Type
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", typ)
+	req.Header.Set(PathHeader, r.Path)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so that the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", ErrPostRejected, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package bigd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+)
+
+// rot13Magic leads the contents of the fake "rot13" format.
+const rot13Magic = "R13:"
+
+// rot13Reader undoes the rotation of the letters read by r.
+type rot13Reader struct {
+	r io.Reader
+}
+
+// Read implements io.Reader.
+func (rr rot13Reader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	for i, b := range p[:n] {
+		switch {
+		case b >= 'a' && b <= 'z':
+			p[i] = 'a' + (b-'a'+13)%26
+		case b >= 'A' && b <= 'Z':
+			p[i] = 'A' + (b-'A'+13)%26
+		}
+	}
+
+	return n, err
+}
+
+// newRot13Reader is a Decompressor of the fake "rot13" format, which holds
+// its magic followed by rotated letters.
+func newRot13Reader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	head := make([]byte, len(rot13Magic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != rot13Magic {
+		return nil, errors.New("missing rot13 magic")
+	}
+
+	return ioutil.NopCloser(rot13Reader{br}), nil
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	Register(".rot13", newRot13Reader, []byte(rot13Magic))
+
+	fsys := fstest.MapFS{
+		"by-name.rot13":  {Data: []byte(rot13Magic + "Uryyb, jbeyq!")},
+		"misnamed.rot13": {Data: []byte("Uryyb, jbeyq!")},
+		"plain.gz":       {Data: gzipped(t, "Hello, gzip!")},
+	}
+
+	// The registered extension is collected by the default filter alongside
+	// the built-in formats.
+	pr := NewProcessor()
+	pr.FS = fsys
+
+	rs, _ := funnelDir(context.Background(), t, pr, ".")
+
+	got := map[string]Result{}
+	for r := range rs {
+		got[r.Path] = r
+	}
+
+	if len(got) != len(fsys) {
+		t.Fatalf("got %d results, want %d", len(got), len(fsys))
+	}
+
+	if r := got["by-name.rot13"]; r.Err != nil || r.Data != "Hello, world!" || r.Format != ".rot13" {
+		t.Errorf("by name: got data %q, format %q, error %v", r.Data, r.Format, r.Err)
+	}
+
+	if r := got["misnamed.rot13"]; !errors.Is(r.Err, ErrBadMagic) {
+		t.Errorf("misnamed: got error %v, want %v", r.Err, ErrBadMagic)
+	}
+
+	if r := got["plain.gz"]; r.Err != nil || r.Data != "Hello, gzip!" {
+		t.Errorf("plain: got data %q, error %v", r.Data, r.Err)
+	}
+
+	// Magic selects the format of files named otherwise.
+	pr = NewProcessor()
+	pr.FS = fstest.MapFS{"by-magic.bin": {Data: []byte(rot13Magic + "Ol zntvp!")}}
+	pr.Magic = true
+
+	rs2 := collect(t, pr, "by-magic.bin")
+	if len(rs2) != 1 {
+		t.Fatalf("got %d results, want 1", len(rs2))
+	}
+
+	if r := rs2[0]; r.Err != nil || r.Data != "By magic!" || r.Format != ".rot13" {
+		t.Errorf("by magic: got data %q, format %q, error %v", r.Data, r.Format, r.Err)
+	}
+}
@@ -0,0 +1,77 @@
+package bigd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isURL reports whether the file located at p is to be fetched over HTTP
+// rather than opened in the Processor's filesystem.
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// namePath returns the part of p which names the file, so that extensions
+// are judged without any query or fragment of a URL.
+func namePath(p string) string {
+	if !isURL(p) {
+		return p
+	}
+
+	u, err := url.Parse(p)
+	if err != nil {
+		return p
+	}
+
+	return u.Path
+}
+
+// client returns the Processor's HTTP client, or http.DefaultClient if none
+// is set.
+func (pr *Processor) client() *http.Client {
+	if pr.Client == nil {
+		return http.DefaultClient
+	}
+
+	return pr.Client
+}
+
+// fetch requests the file located at the URL p, and returns the response
+// body along with the compressed size given by the response (0 if
+// unknown). The request is canceled once ctx is done. Responses other than
+// 2xx fail with ErrFetchRejected. Returned errors are of type *Error.
+func (pr *Processor) fetch(ctx context.Context, p string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return nil, 0, &Error{Stage: StageOpen, Path: p, Err: err}
+	}
+
+	// Ask for the file as stored, so that the transport does not decompress
+	// a ".gz" file served with a gzip content encoding.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := pr.client().Do(req)
+	if err != nil {
+		return nil, 0, &Error{Stage: StageOpen, Path: p, Err: err}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+
+		err := fmt.Errorf("%w: %s", ErrFetchRejected, resp.Status)
+		return nil, 0, &Error{Stage: StageOpen, Path: p, Err: err}
+	}
+
+	size := resp.ContentLength
+	if size < 0 {
+		size = 0
+	}
+
+	return resp.Body, size, nil
+}
@@ -0,0 +1,117 @@
+package bigd
+
+import "sync"
+
+// Rescanner is a Source which provides the files collected from a set of
+// directories each time Rescan is called, skipping files already provided
+// by an earlier scan. Next blocks while no files are queued, so that a
+// Funnel (and its WorkerPool) keeps running until the Rescanner is closed.
+// Unlike a Watcher, no filesystem notifications are needed.
+type Rescanner struct {
+	pr   *Processor
+	dirs []string
+
+	mu     sync.Mutex
+	queued []FileInfo
+	seen   map[string]struct{}
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewRescanner returns a Rescanner of the provided directories, which are
+// collected as by FilesInfoInEach. No files are queued until Rescan is
+// called.
+func NewRescanner(pr *Processor, dirs []string) *Rescanner {
+	return &Rescanner{
+		pr:   pr,
+		dirs: append([]string(nil), dirs...),
+		seen: make(map[string]struct{}),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// Rescan collects the directories, queues the files not seen before, and
+// returns the amount queued along with the errors of any subdirectories
+// skipped (see FilesInfo.Skipped). Nothing is queued if collecting fails.
+// Rescan may be called from any goroutine (e.g. a signal handler).
+func (rs *Rescanner) Rescan() (int, []error, error) {
+	fsis, err := rs.pr.FilesInfoInEach(rs.dirs)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var n int
+	var skipped []error
+	for _, fsi := range fsis {
+		skipped = append(skipped, fsi.Skipped...)
+
+		for _, fi := range fsi.Files {
+			if _, ok := rs.seen[fi.Path()]; ok {
+				continue
+			}
+			rs.seen[fi.Path()] = struct{}{}
+
+			rs.queued = append(rs.queued, fi)
+			n++
+		}
+	}
+
+	if n > 0 {
+		select {
+		case rs.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return n, skipped, nil
+}
+
+// Next implements Source. Next blocks until a file is queued, and reports
+// that no files remain once the Rescanner is closed.
+func (rs *Rescanner) Next() (string, int64, bool) {
+	for {
+		select {
+		case <-rs.done:
+			return "", 0, false
+		default:
+		}
+
+		rs.mu.Lock()
+		if len(rs.queued) > 0 {
+			fi := rs.queued[0]
+			rs.queued = rs.queued[1:]
+			rs.mu.Unlock()
+
+			return fi.Path(), fi.Size(), true
+		}
+		rs.mu.Unlock()
+
+		select {
+		case <-rs.wake:
+		case <-rs.done:
+			return "", 0, false
+		}
+	}
+}
+
+// Err implements Source.
+func (rs *Rescanner) Err() error {
+	return nil
+}
+
+// Close stops the Rescanner, so that Next reports that no files remain
+// (e.g. to drain a Funnel). Close may be called from any goroutine, and
+// more than once.
+func (rs *Rescanner) Close() error {
+	rs.once.Do(func() {
+		close(rs.done)
+	})
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package bigd
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// FileInfo holds an os.FileInfo along with the directory the file came
+// from.
+type FileInfo struct {
+	os.FileInfo
+	Dir string
+}
+
+// Path returns the full path of the file.
+func (fi FileInfo) Path() string {
+	return path.Join(fi.Dir, fi.Name())
+}
+
+// FilesInfo holds a slice of FileInfo along with the directory the
+// contents were collected from. Skipped holds the errors of subdirectories
+// which were skipped since they could not be read (see Processor.Strict).
+type FilesInfo struct {
+	Dir     string
+	Files   []FileInfo
+	Skipped []error
+}
+
+// task holds a full file path, size, and options along with the index of
+// the file within the collected files.
+type task struct {
+	idx  int
+	path string
+	size int64
+	opts Options
+}
+
+// Header holds the metadata carried by a gzip header. Any of the fields may
+// be empty since they are optional within the format.
+type Header struct {
+	Name    string
+	Comment string
+	ModTime time.Time
+	OS      byte
+}
+
+// newHeader returns a Header holding the metadata of the provided gzip
+// header.
+func newHeader(h gzip.Header) *Header {
+	return &Header{
+		Name:    h.Name,
+		Comment: h.Comment,
+		ModTime: h.ModTime,
+		OS:      h.OS,
+	}
+}
+
+// MarshalJSON implements json.Marshaler. Empty names, comments, and
+// modification times are omitted.
+func (h Header) MarshalJSON() ([]byte, error) {
+	var modTime *time.Time
+	if !h.ModTime.IsZero() {
+		modTime = &h.ModTime
+	}
+
+	return json.Marshal(struct {
+		Name    string     `json:"name,omitempty"`
+		Comment string     `json:"comment,omitempty"`
+		ModTime *time.Time `json:"mod_time,omitempty"`
+		OS      byte       `json:"os"`
+	}{
+		Name:    h.Name,
+		Comment: h.Comment,
+		ModTime: modTime,
+		OS:      h.OS,
+	})
+}
+
+// Result holds a full file path, processed data, hex encoded hash of the
+// data (if enabled), sniffed content type and text statistics of the data
+// (if enabled), gzip header metadata (if any), compressed and decompressed
+// sizes, and error (if any). The index of the processed file is held so
+// that results can be reordered. Duplicate reports whether the hash has
+// been seen in an earlier result (see Processor.Dedup), and Partial reports
+// whether Data holds only the contents read before the error (see
+// Processor.KeepPartial). Format holds the extension of the compression
+// format selected for the file (e.g. ".gz"), whether by its name, by magic
+// bytes (see Processor.Magic), or by the options of its source, so that the
+// selection can be checked. SkippedMembers holds the amount of corrupt gzip
+// members skipped (see Processor.Tolerant), in which case the contents are
+// incomplete even though Err is nil.
+//
+// Compressed tar archives (e.g. "a.tar.gz" or "a.tgz") produce a result per
+// entry, all sharing the index of the archive. Entry holds the index of the
+// entry within the archive, and More reports whether further results for
+// the same index follow. Archives are not expanded when streaming.
+//
+// When streaming, Data is left empty and the decompressed contents (and
+// error) are instead delivered by reading from Stream, which must be closed
+// once read (or abandoned) so that the digester is released. Streams left
+// open are closed with the context error once processing is canceled, so
+// that stopping early does not strand digesters. DataSize is then left for
+// the consumer to fill in, and Header and Format are left empty since the
+// result is sent before the file is read.
+type Result struct {
+	Index          int
+	Entry          int
+	More           bool
+	Path           string
+	Data           string
+	Partial        bool
+	Hash           string
+	Duplicate      bool
+	Format         string
+	SkippedMembers int
+	Type           string
+	Text           *TextStats
+	Header         *Header
+	Size           int64
+	DataSize       int64
+	Err            error
+	Stream         io.ReadCloser
+
+	// release returns the memory accounted for by the result to the
+	// budget, if any.
+	release func()
+
+	// skip marks results which are dropped by skipEmpty. Marked results
+	// still pass through Ordered so that their indexes are accounted for.
+	skip bool
+}
+
+// Release returns the memory accounted for by the result to the budget set
+// by Processor.MemBudget. When a budget is set, Release must be called once
+// the data of each result is no longer needed, or processing will stall.
+// Calling Release more than once, or when no budget is set, is harmless.
+func (r Result) Release() {
+	if r.release != nil {
+		r.release()
+	}
+}
+
+// MarshalJSON implements json.Marshaler. A nil error is marshaled as null
+// and any other error as the string returned by its Error method.
+func (r Result) MarshalJSON() ([]byte, error) {
+	var errMsg *string
+	if r.Err != nil {
+		msg := r.Err.Error()
+		errMsg = &msg
+	}
+
+	return json.Marshal(struct {
+		Path           string     `json:"path"`
+		Data           string     `json:"data"`
+		Partial        bool       `json:"partial,omitempty"`
+		Hash           string     `json:"hash,omitempty"`
+		Duplicate      bool       `json:"duplicate,omitempty"`
+		Format         string     `json:"format,omitempty"`
+		SkippedMembers int        `json:"skipped_members,omitempty"`
+		Type           string     `json:"content_type,omitempty"`
+		Text           *TextStats `json:"text,omitempty"`
+		Header         *Header    `json:"header,omitempty"`
+		Error          *string    `json:"error"`
+	}{
+		Path:           r.Path,
+		Data:           r.Data,
+		Partial:        r.Partial,
+		Hash:           r.Hash,
+		Duplicate:      r.Duplicate,
+		Format:         r.Format,
+		SkippedMembers: r.SkippedMembers,
+		Type:           r.Type,
+		Text:           r.Text,
+		Header:         r.Header,
+		Error:          errMsg,
+	})
+}
@@ -0,0 +1,120 @@
+package bigd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// scaleInterval is the interval at which a scaler reviews the waits
+	// observed since its previous review.
+	scaleInterval = 250 * time.Millisecond
+
+	// scaleThreshold is the amount of time per interval which submits or
+	// results must have spent waiting before the width is changed.
+	scaleThreshold = scaleInterval / 4
+)
+
+// scaler adjusts the amount of running digesters between 1 and max. A
+// digester is added while files wait on busy digesters (digesters are the
+// bottleneck), and retired while results wait on the consumer (the consumer
+// is the bottleneck).
+type scaler struct {
+	max    int
+	width  int
+	retire chan struct{}
+
+	starved atomic.Int64 // time submits waited on busy digesters
+	stalled atomic.Int64 // time results waited on the consumer
+}
+
+// newScaler returns a scaler which allows up to max digesters. A nil scaler
+// is returned if adaptive is not set, and results in a fixed width.
+func newScaler(adaptive bool, max int) *scaler {
+	if !adaptive {
+		return nil
+	}
+
+	return &scaler{max: max, width: 1, retire: make(chan struct{}, max)}
+}
+
+// retired returns the channel digesters receive from to be retired. A nil
+// scaler returns nil, which blocks forever.
+func (s *scaler) retired() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+
+	return s.retire
+}
+
+// starve adds the time since start to the time submits waited on busy
+// digesters. A nil scaler results in a no-op.
+func (s *scaler) starve(start time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.starved.Add(int64(time.Since(start)))
+}
+
+// relay sends results received from in to out, and adds the time spent
+// waiting on the consumer to the time results were stalled. Results which
+// cannot be sent once ctx is done are released. Out is closed once in is
+// closed.
+func (s *scaler) relay(ctx context.Context, in <-chan Result, out chan<- Result) {
+	defer close(out)
+
+	for r := range in {
+		select {
+		case out <- r:
+			continue
+		default:
+		}
+
+		start := time.Now()
+
+		select {
+		case out <- r:
+		case <-ctx.Done():
+			r.Release()
+		}
+
+		s.stalled.Add(int64(time.Since(start)))
+	}
+}
+
+// run reviews the observed waits at each interval, and calls spawn to add
+// a digester or sends on the retire channel to retire one. Run returns once
+// quit is closed or ctx is done.
+func (s *scaler) run(ctx context.Context, quit <-chan struct{}, spawn func()) {
+	t := time.NewTicker(scaleInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		stalled := time.Duration(s.stalled.Swap(0))
+		starved := time.Duration(s.starved.Swap(0))
+
+		switch {
+		case stalled > scaleThreshold && s.width > 1:
+			select {
+			case s.retire <- struct{}{}:
+				s.width--
+			default:
+			}
+
+		case starved > scaleThreshold && stalled < scaleThreshold && s.width < s.max:
+			spawn()
+			s.width++
+		}
+	}
+}
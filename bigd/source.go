@@ -0,0 +1,186 @@
+package bigd
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Source provides the files to be processed. Next is called repeatedly from
+// a single goroutine until it reports that no files remain, after which Err
+// returns any error which ended the source early.
+type Source interface {
+	// Next returns the path and compressed size of the next file. A size of
+	// 0 is treated as unknown, and is determined while processing.
+	Next() (path string, size int64, ok bool)
+
+	// Err returns the error which ended the source early, if any.
+	Err() error
+}
+
+// Options holds settings for a single file which override those of the
+// Processor.
+type Options struct {
+	// Format selects the compression format by its registered extension
+	// (e.g. ".zst") rather than by file name or leading bytes.
+	Format string
+
+	// Hash is the expected hex encoded hash of the decompressed contents,
+	// as computed by the Processor's hash (or "sha256" if none is set). A
+	// mismatch is set as a result error wrapping ErrHashMismatch.
+	Hash string
+}
+
+// OptionsSource is a Source which also provides options for each file.
+type OptionsSource interface {
+	Source
+
+	// Options returns the options of the file most recently returned by
+	// Next.
+	Options() Options
+}
+
+// filesSource provides the files held by a FilesInfo in order.
+type filesSource struct {
+	files []FileInfo
+	i     int
+}
+
+// Source returns a Source which provides the collected files in order.
+func (fsi *FilesInfo) Source() Source {
+	return &filesSource{files: fsi.Files}
+}
+
+// Next implements Source.
+func (s *filesSource) Next() (string, int64, bool) {
+	if s.i >= len(s.files) {
+		return "", 0, false
+	}
+
+	fi := s.files[s.i]
+	s.i++
+
+	return fi.Path(), fi.Size(), true
+}
+
+// Err implements Source.
+func (s *filesSource) Err() error {
+	return nil
+}
+
+// interleaveSource provides files from each of its sources in turn.
+type interleaveSource struct {
+	srcs []Source
+	i    int
+	last Source
+	err  error
+}
+
+// Interleave returns a Source which provides files from each of srcs in
+// turn, so that no source is finished before the others are started (e.g.
+// to spread reads across devices). Sources are dropped once they end, and
+// Err returns the error of the first source to end early. Options of any
+// OptionsSource are passed on.
+func Interleave(srcs ...Source) Source {
+	return &interleaveSource{srcs: append([]Source(nil), srcs...)}
+}
+
+// Next implements Source.
+func (s *interleaveSource) Next() (string, int64, bool) {
+	for len(s.srcs) > 0 {
+		if s.i >= len(s.srcs) {
+			s.i = 0
+		}
+
+		src := s.srcs[s.i]
+		if p, size, ok := src.Next(); ok {
+			s.i++
+			s.last = src
+			return p, size, true
+		}
+
+		if err := src.Err(); err != nil && s.err == nil {
+			s.err = err
+		}
+
+		s.srcs = append(s.srcs[:s.i], s.srcs[s.i+1:]...)
+	}
+
+	return "", 0, false
+}
+
+// Err implements Source.
+func (s *interleaveSource) Err() error {
+	return s.err
+}
+
+// Options implements OptionsSource.
+func (s *interleaveSource) Options() Options {
+	if src, ok := s.last.(OptionsSource); ok {
+		return src.Options()
+	}
+
+	return Options{}
+}
+
+// pathSource provides a fixed list of paths in order.
+type pathSource struct {
+	paths []string
+	i     int
+}
+
+// NewPathSource returns a Source which provides the provided paths in order
+// (e.g. command line arguments). Paths are not validated until they are
+// processed, so missing files are reported as result errors.
+func NewPathSource(paths ...string) Source {
+	return &pathSource{paths: append([]string(nil), paths...)}
+}
+
+// Next implements Source.
+func (s *pathSource) Next() (string, int64, bool) {
+	if s.i >= len(s.paths) {
+		return "", 0, false
+	}
+
+	p := s.paths[s.i]
+	s.i++
+
+	return p, 0, true
+}
+
+// Err implements Source.
+func (s *pathSource) Err() error {
+	return nil
+}
+
+// lineSource provides newline-separated paths read from a reader.
+type lineSource struct {
+	sc *bufio.Scanner
+}
+
+// NewLineSource returns a Source which provides newline-separated paths read
+// from r (e.g. the output of find). Blank lines are skipped. Paths are not
+// validated until they are processed, so missing files are reported as
+// result errors.
+func NewLineSource(r io.Reader) Source {
+	return &lineSource{sc: bufio.NewScanner(r)}
+}
+
+// Next implements Source.
+func (s *lineSource) Next() (string, int64, bool) {
+	for s.sc.Scan() {
+		line := strings.TrimSuffix(s.sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		return line, 0, true
+	}
+
+	return "", 0, false
+}
+
+// Err implements Source.
+func (s *lineSource) Err() error {
+	return s.sc.Err()
+}
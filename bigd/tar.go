@@ -0,0 +1,175 @@
+package bigd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// isTar reports whether the file located at p is a compressed tar archive,
+// as judged by its name (e.g. "a.tar.gz" or "a.tgz").
+func isTar(p string) bool {
+	p = namePath(p)
+	if path.Ext(p) == ".tgz" {
+		return true
+	}
+
+	return path.Ext(strings.TrimSuffix(p, path.Ext(p))) == ".tar"
+}
+
+// digestTar processes the compressed tar archive described by r, and sends
+// out a result for each regular entry within the archive. Directory entries
+// (and other entries without contents, e.g. links) are skipped. Each result
+// path is the archive path followed by the entry name. The archive size is
+// held by the final result only, so that it is counted once, and an archive
+// without regular entries still sends a single result. Retries are not
+// attempted since earlier entries may already have been sent. A format
+// which is not empty overrides the selection of the compression format.
+// False is returned if ctx is done before all results are sent.
+func (pr *Processor) digestTar(ctx context.Context, r Result, format string, c chan<- Result, sh *shared) bool {
+	send := func(r Result) bool {
+		pr.report(ctx, &r, sh.seen)
+
+		select {
+		case c <- r:
+			return true
+		case <-ctx.Done():
+			r.Release()
+			return false
+		}
+	}
+
+	rctx := ctx
+	if pr.Timeout > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(ctx, pr.Timeout)
+		defer cancel()
+	}
+
+	p := r.Path
+
+	if !sh.fds.acquire(ctx) {
+		return false
+	}
+	defer sh.fds.release()
+
+	src, _, ext, closeAll, err := pr.open(rctx, p, format, nil)
+	r.Format = ext
+	if err != nil {
+		r.Err = err
+		return send(r)
+	}
+	defer closeAll()
+
+	size := r.Size
+	base := r
+	base.Size = 0
+
+	var last *Result
+	tr := tar.NewReader(src)
+
+	for entry := 0; ; {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		er := base
+		er.Entry = entry
+
+		if err == nil && !th.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		// A further result follows, so the previous one can be sent before
+		// this one is read (and holds any of the memory budget).
+		if last != nil {
+			last.More = true
+			if !send(*last) {
+				return false
+			}
+		}
+
+		if err == nil {
+			er.Path = p + "/" + path.Clean(th.Name)
+
+			held := sh.mem.resize(ctx, 0, th.Size)
+			er.Data, er.Hash, err = pr.readEntry(tr)
+			if err != nil {
+				er.Data, er.Partial = pr.partial(er.Data)
+			}
+			er.DataSize = int64(len(er.Data))
+			if pr.Sniff && err == nil {
+				er.Type = sniff(er.Data)
+			}
+			if pr.TextStats && err == nil {
+				er.Text = textStatsOf(er.Data)
+			}
+
+			held = sh.mem.resize(ctx, held, er.DataSize)
+			er.release = sh.mem.releaser(held)
+			er.skip = pr.SkipEmpty && err == nil && er.DataSize == 0
+		}
+
+		if err != nil {
+			er.Err = &Error{Stage: StageRead, Path: p, Err: err}
+			if rctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				er.Err = ErrTimeout
+			}
+		}
+
+		last = &er
+		entry++
+
+		if er.Err != nil {
+			break
+		}
+	}
+
+	if last == nil {
+		last = &base
+		last.skip = pr.SkipEmpty
+	}
+	last.Size = size
+
+	if pr.Slow {
+		time.Sleep(time.Second)
+	}
+
+	return send(*last)
+}
+
+// readEntry reads the current entry of tr (filtered by the Processor's grep,
+// if set), and returns its contents along with the hex encoded hash of the
+// contents (if enabled). On error, the contents read before it are
+// returned.
+func (pr *Processor) readEntry(tr *tar.Reader) (string, string, error) {
+	var h hash.Hash
+	var src io.Reader = tr
+	if pr.Grep != nil {
+		src = newGrepReader(src, pr.Grep)
+	}
+
+	if pr.Hash != "" {
+		h = hashes[pr.Hash]()
+		src = io.TeeReader(src, h)
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return string(data), "", err
+	}
+
+	var sum string
+	if h != nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return string(data), sum, nil
+}
@@ -0,0 +1,63 @@
+package bigd
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDigestTarEntries(t *testing.T) {
+	const (
+		archive = "../testdata/tar/entries.tar.gz"
+		plain   = "../testdata/multistream/members.gz"
+	)
+
+	fi, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr := NewProcessor()
+	pr.Ordered = true
+
+	rs := collect(t, pr, archive, plain)
+
+	// Directory entries ("entries/" and "entries/sub/") are skipped, and
+	// the archive size is held by its final result only.
+	want := []struct {
+		index, entry int
+		more         bool
+		path, data   string
+		size         int64
+	}{
+		{0, 0, true, archive + "/entries/a.txt", "This is entry #a.\n", 0},
+		{0, 1, false, archive + "/entries/sub/b.txt", "This is entry #b.\n", fi.Size()},
+		{1, 0, false, plain, "This is member #1.\nThis is member #2.\n", 0},
+	}
+
+	if len(rs) != len(want) {
+		t.Fatalf("got %d results, want %d", len(rs), len(want))
+	}
+
+	for i, w := range want {
+		r := rs[i]
+		if r.Err != nil {
+			t.Fatalf("result %d: got error %v, want none", i, r.Err)
+		}
+		if r.Index != w.index || r.Entry != w.entry || r.More != w.more {
+			t.Errorf("result %d: got index %d, entry %d, more %t, want %d, %d, %t",
+				i, r.Index, r.Entry, r.More, w.index, w.entry, w.more)
+		}
+		if r.Path != w.path {
+			t.Errorf("result %d: got path %q, want %q", i, r.Path, w.path)
+		}
+		if r.Data != w.data {
+			t.Errorf("result %d: got data %q, want %q", i, r.Data, w.data)
+		}
+		if w.index == 0 && r.Size != w.size {
+			t.Errorf("result %d: got size %d, want %d", i, r.Size, w.size)
+		}
+		if r.Format != ".gz" {
+			t.Errorf("result %d: got format %q, want %q", i, r.Format, ".gz")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package bigd
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextStats holds statistics of decompressed contents which are useful for
+// text (e.g. logs). Lines counts newline characters, so a final line
+// without one is not counted.
+type TextStats struct {
+	Lines int64 `json:"lines"`
+	UTF8  bool  `json:"utf8"`
+}
+
+// textStatsOf returns the statistics of data.
+func textStatsOf(data string) *TextStats {
+	return &TextStats{
+		Lines: int64(strings.Count(data, "\n")),
+		UTF8:  utf8.ValidString(data),
+	}
+}
+
+// textCounter gathers statistics of the contents written to it, so that
+// contents need not be held. Runes split across writes are validated once
+// complete.
+type textCounter struct {
+	lines   int64
+	invalid bool
+	buf     [utf8.UTFMax]byte
+	rest    []byte // incomplete rune held back from the previous write
+}
+
+// Write implements io.Writer.
+func (tc *textCounter) Write(p []byte) (int, error) {
+	tc.lines += int64(bytes.Count(p, []byte{'\n'}))
+
+	if tc.invalid {
+		return len(p), nil
+	}
+
+	b := p
+
+	// Complete the rune held back from the previous write.
+	if len(tc.rest) > 0 {
+		held := len(tc.rest)
+		k := len(tc.buf) - held
+		if k > len(b) {
+			k = len(b)
+		}
+
+		head := append(tc.buf[:held], b[:k]...)
+		if !utf8.FullRune(head) {
+			tc.rest = head
+			return len(p), nil
+		}
+
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size == 1 {
+			tc.invalid = true
+			return len(p), nil
+		}
+
+		b = b[size-held:]
+		tc.rest = tc.buf[:0]
+	}
+
+	// Hold back a trailing incomplete rune for the next write.
+	cut := len(b)
+	for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+
+	if !utf8.Valid(b[:cut]) {
+		tc.invalid = true
+		return len(p), nil
+	}
+
+	tc.rest = append(tc.buf[:0], b[cut:]...)
+
+	return len(p), nil
+}
+
+// stats returns the statistics of the contents written so far. Contents
+// ending with an incomplete rune are not valid UTF-8.
+func (tc *textCounter) stats() *TextStats {
+	return &TextStats{
+		Lines: tc.lines,
+		UTF8:  !tc.invalid && len(tc.rest) == 0,
+	}
+}
@@ -0,0 +1,235 @@
+package bigd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// tolerantReader reads the members of a concatenated gzip file in turn, and
+// skips those which are corrupt by scanning for the header of the next
+// member. Each member is buffered until it ends cleanly (its checksum and
+// length are verified), so that nothing decompressed from a corrupt member
+// is returned. Each skipped member is counted in skipped, as are bytes
+// between members which are followed by a further member, and a header
+// cut short at the end. Trailing bytes (e.g. padding) which hold no further
+// member header end reading as usual.
+type tolerantReader struct {
+	gzr     *gzip.Reader
+	rw      *rewindReader
+	r       io.Reader
+	skipped *int
+
+	member bytes.Buffer
+	out    []byte
+	err    error
+}
+
+// newTolerantReader returns a tolerantReader of the members read by gzr
+// from rw, where gzr has read the header of the first member. Decompressed
+// contents are read from gzr through r, which may wrap gzr (e.g. to limit
+// the contents buffered).
+func newTolerantReader(gzr *gzip.Reader, rw *rewindReader, r io.Reader, skipped *int) *tolerantReader {
+	gzr.Multistream(false)
+
+	return &tolerantReader{gzr: gzr, rw: rw, r: r, skipped: skipped}
+}
+
+// Read implements io.Reader.
+func (t *tolerantReader) Read(p []byte) (int, error) {
+	for len(t.out) == 0 && t.err == nil {
+		t.readMember()
+	}
+
+	if len(t.out) == 0 {
+		return 0, t.err
+	}
+
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+
+	return n, nil
+}
+
+// readMember reads the current member whole, and moves on to the next. The
+// contents of a member which ends cleanly are held to be returned, while a
+// corrupt member is counted and dropped. Any other error ends reading with
+// that error.
+func (t *tolerantReader) readMember() {
+	t.member.Reset()
+
+	_, err := io.Copy(&t.member, t.r)
+	switch {
+	case err == nil:
+		t.out = t.member.Bytes()
+
+		// Bytes scanned past before the next member are counted as a
+		// skipped member, since they are likely one with a corrupt header,
+		// as is a header which cannot be read before the end.
+		n, started, err := t.resync()
+		if (n > 0 && err == nil) || (started && err == io.EOF) {
+			*t.skipped++
+		}
+		t.err = err
+
+	case corrupt(err):
+		*t.skipped++
+
+		// The corrupt member may have been read into the next (e.g. when
+		// truncated), so its bytes are scanned again.
+		t.rw.rewind()
+		_, _, t.err = t.resync()
+
+	default:
+		t.err = err
+	}
+}
+
+// resync discards bytes up to the header of the next member which can be
+// read, resets gzr to decompress it, and returns the amount of bytes
+// discarded along with whether any header failed to be read. The deflate
+// method is required along with the magic bytes, so that fewer false starts
+// are attempted. io.EOF is returned if no member remains.
+func (t *tolerantReader) resync() (int, bool, error) {
+	var started bool
+
+	for n := 0; ; n++ {
+		ok, err := t.rw.atHeader()
+		if err != nil {
+			return n, started, err
+		}
+
+		if ok {
+			t.rw.mark()
+
+			err := t.gzr.Reset(t.rw)
+			if err == nil {
+				t.gzr.Multistream(false)
+				return n, started, nil
+			}
+
+			if err != io.EOF && !corrupt(err) {
+				return n, started, err
+			}
+			started = true
+
+			// The failed header may have been read into a real one, so its
+			// bytes are scanned again.
+			t.rw.rewind()
+			continue
+		}
+
+		if _, err := t.rw.ReadByte(); err != nil {
+			return n, started, err
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (t *tolerantReader) Close() error {
+	return t.gzr.Close()
+}
+
+// rewindReader reads from br, and records the bytes read since the start
+// of the current gzip member, so that the bytes of a member which turns out
+// to be corrupt can be scanned again for the header of a further member.
+// Recording stops once record is unset (e.g. for other formats).
+type rewindReader struct {
+	br     *bufio.Reader
+	again  []byte
+	raw    []byte
+	record bool
+}
+
+// newRewindReader returns a rewindReader of br which records from the
+// start.
+func newRewindReader(br *bufio.Reader) *rewindReader {
+	return &rewindReader{br: br, record: true}
+}
+
+// ReadByte implements io.ByteReader, which gzip (and flate) readers read
+// through directly, so that no bytes are read ahead of the member.
+func (r *rewindReader) ReadByte() (byte, error) {
+	var b byte
+	if len(r.again) > 0 {
+		b, r.again = r.again[0], r.again[1:]
+	} else {
+		var err error
+		if b, err = r.br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.record {
+		r.raw = append(r.raw, b)
+	}
+
+	return b, nil
+}
+
+// Read implements io.Reader.
+func (r *rewindReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(r.again) > 0 {
+		n = copy(p, r.again)
+		r.again = r.again[n:]
+	} else {
+		n, err = r.br.Read(p)
+	}
+
+	if r.record {
+		r.raw = append(r.raw, p[:n]...)
+	}
+
+	return n, err
+}
+
+// mark starts the recording of a further member.
+func (r *rewindReader) mark() {
+	r.raw = r.raw[:0]
+}
+
+// rewind arranges for the bytes recorded since the mark, other than the
+// first, to be read again.
+func (r *rewindReader) rewind() {
+	if len(r.raw) > 1 {
+		r.again = append(append([]byte(nil), r.raw[1:]...), r.again...)
+	}
+
+	r.raw = r.raw[:0]
+}
+
+// atHeader reports whether the next bytes to be read start a gzip member
+// (magic bytes followed by the deflate method). io.EOF is returned once too
+// few bytes remain to hold a member.
+func (r *rewindReader) atHeader() (bool, error) {
+	head := r.again
+	if len(head) < 3 {
+		peek, err := r.br.Peek(3 - len(head))
+		if len(peek) < 3-len(head) {
+			if err == nil || err == bufio.ErrBufferFull {
+				err = io.EOF
+			}
+			return false, err
+		}
+
+		head = append(append(make([]byte, 0, 3), head...), peek...)
+	}
+
+	return head[0] == 0x1f && head[1] == 0x8b && head[2] == 0x08, nil
+}
+
+// corrupt reports whether err was caused by corrupt (or truncated) gzip
+// contents rather than by failing to read them.
+func corrupt(err error) bool {
+	var cie flate.CorruptInputError
+
+	return errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &cie)
+}
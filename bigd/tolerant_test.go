@@ -0,0 +1,131 @@
+package bigd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTolerantMembers(t *testing.T) {
+	a, b, c := gzipped(t, "alpha\n"), gzipped(t, "bravo\n"), gzipped(t, "charlie\n")
+
+	// badCRC fails its checksum only once its contents are decompressed.
+	badCRC := append([]byte(nil), b...)
+	badCRC[len(badCRC)-8] ^= 0xff
+
+	// badData fails within its compressed contents.
+	badData := append([]byte(nil), b...)
+	badData[12] ^= 0xff
+
+	// Large members are read in many chunks.
+	large := strings.Repeat("0123456789abcdef", 1<<14)
+	l := gzipped(t, large)
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		skipped int
+	}{
+		{"clean", join(a, b, c), "alpha\nbravo\ncharlie\n", 0},
+		{"bad checksum", join(a, badCRC, c), "alpha\ncharlie\n", 1},
+		{"bad data", join(a, badData, c), "alpha\ncharlie\n", 1},
+		{"bad members", join(badCRC, a, badData, badCRC, c), "alpha\ncharlie\n", 3},
+		{"large", join(l, badCRC, l), large + large, 1},
+		{"truncated last", join(a, c[:len(c)-4]), "alpha\n", 1},
+		{"truncated first", join(c[:len(c)-4], a), "alpha\n", 1},
+		{"junk between", join(a, []byte("junk"), c), "alpha\ncharlie\n", 1},
+		{"truncated header", join(a, c[:4]), "alpha\n", 1},
+		{"zero padding", join(a, c, make([]byte, 512)), "alpha\ncharlie\n", 0},
+		{"junk trailing", join(a, c, []byte("junk\n\x1f\x8b")), "alpha\ncharlie\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.FS = fstest.MapFS{"x.gz": {Data: tt.data}}
+			pr.Tolerant = true
+
+			rs := collect(t, pr, "x.gz")
+			if len(rs) != 1 {
+				t.Fatalf("got %d results, want 1", len(rs))
+			}
+
+			r := rs[0]
+			if r.Err != nil {
+				t.Fatalf("got error %v, want none", r.Err)
+			}
+			if r.Data != tt.want {
+				t.Errorf("got data %q, want %q", r.Data, tt.want)
+			}
+			if r.SkippedMembers != tt.skipped {
+				t.Errorf("got %d skipped members, want %d", r.SkippedMembers, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestTolerantOtherFormats(t *testing.T) {
+	// Formats other than gzip are read as usual.
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, _ = zw.Write([]byte("zlib\n"))
+	_ = zw.Close()
+
+	pr := NewProcessor()
+	pr.FS = fstest.MapFS{"x.zz": {Data: buf.Bytes()}}
+	pr.Tolerant = true
+
+	rs := collect(t, pr, "x.zz")
+	if len(rs) != 1 {
+		t.Fatalf("got %d results, want 1", len(rs))
+	}
+
+	if r := rs[0]; r.Err != nil || r.Data != "zlib\n" {
+		t.Fatalf("got data %q and error %v, want %q", r.Data, r.Err, "zlib\n")
+	}
+}
+
+func TestTolerantLimits(t *testing.T) {
+	// A member larger than the limit fails while it is buffered, rather
+	// than once it is returned.
+	data := gzipped(t, strings.Repeat("a", 1<<20))
+
+	pr := NewProcessor()
+	pr.FS = fstest.MapFS{"x.gz": {Data: data}}
+	pr.Tolerant = true
+	pr.MaxSize = 1 << 10
+
+	rs := collect(t, pr, "x.gz")
+	if len(rs) != 1 {
+		t.Fatalf("got %d results, want 1", len(rs))
+	}
+
+	if !errors.Is(rs[0].Err, ErrTooLarge) {
+		t.Fatalf("got error %v, want %v", rs[0].Err, ErrTooLarge)
+	}
+}
+
+func TestIntolerantMembers(t *testing.T) {
+	b := gzipped(t, "bravo\n")
+	b[len(b)-8] ^= 0xff
+
+	pr := NewProcessor()
+	pr.FS = fstest.MapFS{"x.gz": {Data: append(gzipped(t, "alpha\n"), b...)}}
+
+	rs := collect(t, pr, "x.gz")
+	if len(rs) != 1 {
+		t.Fatalf("got %d results, want 1", len(rs))
+	}
+
+	if r := rs[0]; r.Err == nil || r.SkippedMembers != 0 {
+		t.Fatalf("got error %v and %d skipped members, want a failure", r.Err, r.SkippedMembers)
+	}
+}
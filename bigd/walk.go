@@ -0,0 +1,121 @@
+package bigd
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// errWalkStopped stops a walk once its Walker is closed.
+var errWalkStopped = errors.New("walk stopped")
+
+// Walker is a Source which provides the files within a directory as they
+// are found, so that processing starts without waiting on the collection of
+// large directory trees. Files are collected in a separate goroutine, which
+// runs ahead of Next by a small buffer, and stops once the Walker is closed.
+type Walker struct {
+	c    chan FileInfo
+	fin  chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	// err and skipped are set before c and fin are closed.
+	err     error
+	skipped []error
+}
+
+// walkBuffer is the amount of files a Walker holds ahead of Next.
+const walkBuffer = 64
+
+// Walk returns a Walker of the files which FilesInfoIn would collect within
+// the provided directory, in the same order except that the Processor's
+// sort is not applied. Collection starts immediately. If collecting fails
+// (e.g. the Processor is strict), files found before the failure are still
+// provided, and Err returns the error.
+func (pr *Processor) Walk(dir string) *Walker {
+	wk := &Walker{
+		c:    make(chan FileInfo, walkBuffer),
+		fin:  make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go pr.walk(wk, dir)
+
+	return wk
+}
+
+// walk sends the files within dir to wk until all are sent or wk is closed.
+func (pr *Processor) walk(wk *Walker, dir string) {
+	defer close(wk.fin)
+	defer close(wk.c)
+
+	var parents []os.FileInfo
+	if pr.Follow {
+		fi, err := fs.Stat(pr.fsys(), dir)
+		if err != nil {
+			wk.err = err
+			return
+		}
+
+		parents = []os.FileInfo{fi}
+	}
+
+	var skipped *[]error
+	if !pr.Strict {
+		skipped = new([]error)
+	}
+
+	err := walkFiles(pr.fsys(), dir, pr.Depth, pr.Filter, parents, skipped, func(fi FileInfo) error {
+		select {
+		case wk.c <- fi:
+			return nil
+		case <-wk.done:
+			return errWalkStopped
+		}
+	})
+	if err != nil && err != errWalkStopped {
+		wk.err = err
+	}
+
+	if skipped != nil {
+		wk.skipped = *skipped
+	}
+}
+
+// Next implements Source. Next blocks until a file is found, and reports
+// that no files remain once the walk has finished, failed, or been stopped
+// by Close.
+func (wk *Walker) Next() (string, int64, bool) {
+	fi, ok := <-wk.c
+	if !ok {
+		return "", 0, false
+	}
+
+	return fi.Path(), fi.Size(), true
+}
+
+// Err implements Source.
+func (wk *Walker) Err() error {
+	return wk.err
+}
+
+// Skipped returns the errors of any subdirectories which were skipped since
+// they could not be read (see FilesInfo.Skipped). Skipped blocks until the
+// walk has finished or been stopped by Close.
+func (wk *Walker) Skipped() []error {
+	<-wk.fin
+
+	return wk.skipped
+}
+
+// Close stops the walk, so that Next reports that no files remain once the
+// files already found are provided. Close may be called from any goroutine,
+// and more than once.
+func (wk *Walker) Close() error {
+	wk.once.Do(func() {
+		close(wk.done)
+	})
+
+	return nil
+}
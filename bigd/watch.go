@@ -0,0 +1,258 @@
+package bigd
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// minSettleTick is the shortest interval pending files are checked at.
+const minSettleTick = time.Millisecond
+
+// pendingFile holds the size of a file which is not yet settled, and when
+// it last changed.
+type pendingFile struct {
+	size    int64
+	changed time.Time
+}
+
+// readyFile holds the path and size of a settled file.
+type readyFile struct {
+	path string
+	size int64
+}
+
+// Watcher is a Source which provides the files arriving in watched
+// directories, so that a Funnel (and its WorkerPool) keeps processing them
+// until the Watcher is closed. Files are provided once they are settled:
+// unchanged in size and without events for the Processor's settle duration,
+// so that files still being written are not read early.
+type Watcher struct {
+	pr *Processor
+	w  *fsnotify.Watcher
+
+	settle  time.Duration
+	tick    *time.Ticker
+	pending map[string]pendingFile
+	ready   []readyFile
+
+	done    chan struct{}
+	once    sync.Once
+	stopped sync.Once
+	err     error
+}
+
+// Watch returns a Watcher of the provided directories. Files already within
+// the directories are provided as well as those arriving, so that files
+// arriving while nothing was watching are not missed. Only files directly
+// within each directory which match the Processor's filter are provided
+// (i.e. as with a depth of 1), and files written to again after settling
+// are provided again. Links to files are provided only if the Processor
+// follows links. Watch requires the operating system's filesystem.
+func (pr *Processor) Watch(dirs []string) (*Watcher, error) {
+	if pr.FS != nil {
+		return nil, errors.New("watch requires the operating system's filesystem")
+	}
+
+	settle := pr.Settle
+	if settle <= 0 {
+		settle = DefaultSettle
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	wr := &Watcher{
+		pr:      pr,
+		w:       w,
+		settle:  settle,
+		pending: make(map[string]pendingFile),
+		done:    make(chan struct{}),
+	}
+
+	// Watch before collecting, so that no file arrives unseen in between.
+	// Files seen by both are held once, and links are followed by both
+	// only if the Processor follows links.
+	for _, dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for _, dir := range dirs {
+		var parents []os.FileInfo
+		if pr.Follow {
+			fi, err := fs.Stat(pr.fsys(), dir)
+			if err != nil {
+				_ = w.Close()
+				return nil, err
+			}
+
+			parents = []os.FileInfo{fi}
+		}
+
+		fis, err := filesIn(pr.fsys(), dir, 1, pr.Filter, parents, nil)
+		if err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+
+		for _, fi := range fis {
+			wr.pending[fi.Path()] = pendingFile{size: fi.Size(), changed: now}
+		}
+	}
+
+	// Check pending files twice per settle duration, though not more often
+	// than the minimum (settle durations under 2ns would be a tick of 0,
+	// which panics).
+	interval := settle / 2
+	if interval < minSettleTick {
+		interval = minSettleTick
+	}
+	wr.tick = time.NewTicker(interval)
+
+	return wr, nil
+}
+
+// Next implements Source. Next blocks until a file is settled, and reports
+// that no files remain once the Watcher is closed or fails.
+func (wr *Watcher) Next() (string, int64, bool) {
+	select {
+	case <-wr.done:
+		wr.stop()
+		return "", 0, false
+	default:
+	}
+
+	for len(wr.ready) == 0 {
+		select {
+		case ev, ok := <-wr.w.Events:
+			if !ok {
+				wr.stop()
+				return "", 0, false
+			}
+			wr.note(ev)
+
+		case err, ok := <-wr.w.Errors:
+			if ok && wr.err == nil {
+				wr.err = err
+			}
+			wr.stop()
+			return "", 0, false
+
+		case <-wr.tick.C:
+			wr.settleFiles()
+
+		case <-wr.done:
+			wr.stop()
+			return "", 0, false
+		}
+	}
+
+	rf := wr.ready[0]
+	wr.ready = wr.ready[1:]
+
+	return rf.path, rf.size, true
+}
+
+// note records the change of a file reported by ev. Removed and renamed
+// files are dropped until they arrive again.
+func (wr *Watcher) note(ev fsnotify.Event) {
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		delete(wr.pending, ev.Name)
+		return
+	}
+
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+
+	fi, err := wr.stat(ev.Name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+
+	wr.pending[ev.Name] = pendingFile{size: fi.Size(), changed: time.Now()}
+}
+
+// settleFiles moves the pending files which have settled to those ready,
+// in name order. Files which are found to have changed are held for
+// another settle duration, and those which no longer match the filter (or
+// exist) are dropped.
+func (wr *Watcher) settleFiles() {
+	var settled []readyFile
+
+	for p, pf := range wr.pending {
+		if time.Since(pf.changed) < wr.settle {
+			continue
+		}
+
+		fi, err := wr.stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			delete(wr.pending, p)
+			continue
+		}
+
+		if fi.Size() != pf.size {
+			wr.pending[p] = pendingFile{size: fi.Size(), changed: time.Now()}
+			continue
+		}
+
+		delete(wr.pending, p)
+		if wr.pr.Filter.match(fi) {
+			settled = append(settled, readyFile{path: p, size: pf.size})
+		}
+	}
+
+	sort.Slice(settled, func(i, j int) bool {
+		return settled[i].path < settled[j].path
+	})
+
+	wr.ready = append(wr.ready, settled...)
+}
+
+// stat returns the file info of the named file, following symbolic links
+// only if the Processor follows links.
+func (wr *Watcher) stat(name string) (os.FileInfo, error) {
+	if wr.pr.Follow {
+		return os.Stat(name)
+	}
+
+	return os.Lstat(name)
+}
+
+// stop releases the underlying watcher and ticker. It may be called from
+// any goroutine, and more than once.
+func (wr *Watcher) stop() {
+	wr.stopped.Do(func() {
+		wr.tick.Stop()
+		_ = wr.w.Close()
+	})
+}
+
+// Err implements Source.
+func (wr *Watcher) Err() error {
+	return wr.err
+}
+
+// Close stops the Watcher, so that Next reports that no files remain (e.g.
+// to drain a Funnel), and releases the underlying watcher whether or not
+// Next is called again. Close may be called from any goroutine, and more
+// than once.
+func (wr *Watcher) Close() error {
+	wr.once.Do(func() {
+		close(wr.done)
+	})
+	wr.stop()
+
+	return nil
+}
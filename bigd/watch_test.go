@@ -0,0 +1,126 @@
+package bigd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWatcherCloseReleases(t *testing.T) {
+	pr := NewProcessor()
+
+	wr, err := pr.Watch([]string{t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The underlying watcher is closed without Next being called.
+	select {
+	case _, ok := <-wr.w.Events:
+		if ok {
+			t.Fatal("got an event, want the watcher closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher was not closed")
+	}
+
+	if _, _, ok := wr.Next(); ok {
+		t.Fatal("got a file, want none")
+	}
+}
+
+func TestWatcherCloseDuringNext(t *testing.T) {
+	pr := NewProcessor()
+
+	wr, err := pr.Watch([]string{t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if _, _, ok := wr.Next(); ok {
+			t.Error("got a file, want none")
+		}
+		close(done)
+	}()
+
+	// Close releases the watcher while Next may be doing the same.
+	for i := 0; i < 2; i++ {
+		if err := wr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next did not return after Close")
+	}
+}
+
+func TestWatcherFollow(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links may not be created on windows")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.gz"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(t.TempDir(), "target.gz")
+	if err := os.WriteFile(target, []byte("target"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "link.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		follow bool
+		want   []string
+	}{
+		{"not followed", false, []string{"a.gz"}},
+		{"followed", true, []string{"a.gz", "link.gz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := NewProcessor()
+			pr.Follow = tt.follow
+			pr.Settle = 10 * time.Millisecond
+
+			wr, err := pr.Watch([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The files already within dir are settled well before the
+			// Watcher is closed.
+			tm := time.AfterFunc(500*time.Millisecond, func() { _ = wr.Close() })
+			defer tm.Stop()
+
+			var got []string
+			for {
+				p, _, ok := wr.Next()
+				if !ok {
+					break
+				}
+				got = append(got, filepath.Base(p))
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,225 +1,2358 @@
 /*
 
-bigd collects file info from the "testdata" directory and concurrently
-processes the files by decompressing the contents and then printing the
-data or related error.
+bigd collects file info from a directory ("testdata" by default) and
+concurrently processes the files by decompressing the contents and then
+printing the data. Errors are collected and reported to stderr once all
+files have been processed, followed by a summary of the run, and the exit
+status is non-zero if any occurred. The work itself is carried out by the
+importable package "github.com/daved/groupthink-bigd/bigd", which this
+command wraps.
 
-The "width" of concurrency is set by the constant "width". Parallelism is
-scheduled properly regardless of CPUs available, and the processing will
-be serial if only one CPU is available. Width, in this case, helps control
-the maximum available goroutines to limit the usage of RAM (see heap
-profile results).
+Supported compression formats are gzip (".gz"), zlib (".zz"), bzip2
+(".bz2"), zstd (".zst"), LZ4 frames (".lz4"), and xz (".xz"). Formats are
+selected by file extension, or by magic bytes if "-magic" is set. Files
+lacking the magic bytes of the format named by their extension fail with a
+"bad magic" error showing the leading bytes seen. Compressed tar archives
+(e.g. ".tar.gz" or ".tgz") are expanded into a result per entry unless
+"-stream" is set.
+
+The "width" of concurrency is set by the flag "-width" (defaulting to the
+constant "bigd.DefaultWidth"). Parallelism is scheduled properly regardless
+of CPUs available, and the processing will be serial if only one CPU is
+available (or if width is 1). Width, in this case, helps control the maximum
+available goroutines to limit the usage of RAM (see heap profile results).
+Decoders for some formats, notably xz, allocate a dictionary per file (up to
+64MB), so peak memory also grows with width. A budget set by "-membudget"
+only accounts for decompressed bytes held by results, not decoder state, so
+lower the width when processing large xz files.
+
+The single-CPU case can be reproduced on any machine with "-serial", which
+sets a width of 1 and limits Go to one CPU (GOMAXPROCS), e.g. when
+debugging ordering or concurrency issues.
+
+Files are read through a buffer of 4096 bytes before decompression, which
+"-readbuf" enlarges. Verifying 32 gzip files totaling 1GB from tmpfs at a
+width of 4, a 1MB buffer cut reads from about 147,000 to 1,100 and the run
+time from 377ms to 316ms. The gain grows with the latency of each read, as
+on spinning disks and networked filesystems.
+
+A first interrupt (e.g. Ctrl-C) drains processing: no further files are
+started, while files already started are finished and output as usual. A
+second interrupt, or any other signal, cancels processing immediately. The
+exit status is non-zero in both cases.
+
+SIGUSR1 pauses processing between files: files already started are
+finished, and no further files are started until SIGUSR2 resumes
+processing. Time spent paused does not count against "-deadline".
+
+SIGHUP collects the directories again if "-rescan" is set, and otherwise
+cancels processing like any other signal.
+
+The exit status is 0 if all files were processed successfully, 1 if any
+files failed or processing stopped early (e.g. due to "-failfast",
+"-deadline", or an interrupt), and 2 if the run could not start (e.g. due
+to invalid flags or a missing directory).
 
 Usage:
 	* This is not properly setup to be built. Use "go run main.go".
 
+Files named as arguments after the flags (e.g. "go run main.go a.gz b.gz")
+are processed as given, without collection. They are processed alongside
+any directories, stdin, or manifest set, and the default directory is only
+collected when no files are named.
+
+Files may also be "http://" or "https://" URLs (whether named, read from
+stdin, or listed in a manifest), which are fetched and processed like any
+other file. Responses other than 2xx fail the file, fetches are held
+against "-maxopen" and "-timeout" like open files, and the compressed
+sizes of fetched files are not counted in the summary.
+
 Available flags:
+	-dir={dirname}
+		Directory to collect compressed files from (default "./testdata/").
+		The flag may be repeated or hold a comma-separated list, in which
+		case directories are collected concurrently and their files are
+		interleaved. A directory of "-" is the same as setting "-stdin".
+	-bootstrap
+		Create the default directory holding 8 generated sample gzip files
+		if it does not exist, so that a first run has data to process.
+		Nothing is written if the directory exists or "-dir" is set.
+	-stdin
+		Read newline-separated file paths from stdin instead of a directory.
+		Collection flags (e.g. "-depth" and "-ext") are not applied.
+	-manifest={filename}
+		Read files from a manifest instead of a directory ("-" reads stdin).
+		Each line holds a JSON object with a "path" and optionally a
+		"format" (e.g. "zst") overriding the compression format, and an
+		"expected_hash" compared to the hash of the contents (see "-hash",
+		sha256 if not set). Mismatches are reported as errors. Collection
+		flags are not applied.
+	-watch
+		Watch the directories and process files as they arrive (along with
+		those already present) until interrupted, rather than collecting
+		them once. Files are processed once settled (see "-settle"), and
+		only files directly within each directory are watched. Cannot be
+		used with "-stdin", "-manifest", "-list", or files named as
+		arguments.
+	-settle={duration}
+		Duration a watched file must remain unchanged for before it is
+		processed, so that files still being written are not read early
+		(default "1s").
+	-rescan
+		Keep running once the collected files are processed, and collect
+		the directories again on SIGHUP until interrupted. Only files not
+		seen by an earlier collection are processed. This is an alternative
+		to "-watch" where filesystem notifications are unavailable. Cannot
+		be used with "-watch", "-stdin", "-manifest", "-list", or files
+		named as arguments.
+	-depth={n}
+		Depth of subdirectories to collect compressed files from (default 1).
+	-strict
+		Fail on any error while collecting. By default, subdirectories which
+		cannot be read due to their permissions are skipped with a warning,
+		and counted in the summary.
+	-walk
+		Process files as they are found while collecting the directories,
+		rather than once collection finishes, so that processing of large
+		directory trees starts immediately. The total amount of files is
+		then unknown (e.g. to "-progress"), and skipped subdirectories are
+		warned of once processing finishes. Cannot be used with "-sort",
+		"-watch", or "-rescan".
+	-width={n}
+		Amount of goroutines running the digest function (default 16).
+	-serial
+		Process files one at a time on a single CPU, as in the single-CPU
+		case described above, by setting a width of 1 and GOMAXPROCS to 1.
+		This overrides "-width", which helps reproduce ordering issues and
+		debug concurrency. Cannot be used with "-adaptive".
+	-adaptive
+		Start with one goroutine running the digest function, and scale the
+		amount while running: more are added while files wait on busy
+		goroutines, and fewer are kept while results wait on output.
+	-maxwidth={n}
+		Cap the amount of goroutines when "-adaptive" is set (default 0,
+		which uses "-width").
+	-deterministic
+		Assign files to goroutines by index modulo "-width" rather than to
+		whichever is free, so that profiles are comparable across runs. The
+		shared assignment (the default) gives the best throughput. Cannot be
+		used with "-adaptive".
+	-buffer={n}
+		Amount of results held while waiting on output (default 0). Buffered
+		results hold decompressed data in memory.
+	-membudget={n}
+		Limit the total decompressed bytes held at once (default 0, no
+		limit). Cannot be used with "-ordered".
+	-maxopen={n}
+		Limit the amount of files held open at once, regardless of width
+		(default 0, no limit). Output files are written one at a time, so
+		add one when setting it against the limit of the OS. Cannot be used
+		with "-ordered" and "-stream" together.
+	-readbuf={n}
+		Size in bytes of the buffer files are read through before
+		decompression (default 0, 4096 bytes). Larger buffers mean fewer,
+		larger reads, which helps on spinning disks and networked
+		filesystems.
+	-rate={n}
+		Limit the amount of files started per second (default 0, no limit).
+		The rate is a ceiling independent of "-width", which still bounds the
+		amount of files in progress at once.
+	-anyext
+		Collect files regardless of extension.
+	-ext={list}
+		Collect only files ending with one of the comma-separated extensions
+		(default ".gz,.zz,.bz2,.zst,.lz4,.xz,.tgz"). The extension also
+		selects the compression format unless "-magic" is set.
+	-pattern={glob}
+		Collect only files with names matching glob (e.g. "2024-*.gz").
+	-since={time}
+		Collect only files modified at or after the time, which is either
+		RFC3339 (e.g. "2024-01-02T15:04:05Z") or a duration before now
+		(e.g. "24h").
+	-until={time}
+		Collect only files modified at or before the time, in the same form
+		as "-since".
+	-minsize={n}
+		Collect only files of at least n compressed bytes (default 0).
+	-maxsize-compressed={n}
+		Collect only files of at most n compressed bytes (default 0, no
+		limit). Unlike "-maxsize", this excludes files during collection.
+	-sort={key}
+		Order collected files by "name" (full path), "size", or "mtime",
+		ascending. By default, files are ordered by name within each
+		directory.
+	-count={n}
+		Process only the first n files provided (default 0, no limit), e.g.
+		to sample a large directory. Further files are never started, and
+		combined with "-sort" the sample is deterministic. Each tar archive
+		counts as a single file.
+	-follow
+		Follow symbolic links to files and directories (within "-depth"),
+		which are otherwise skipped. Links which loop are skipped.
+	-magic
+		Select compression formats by magic bytes instead of extension. The
+		format selected for each file (e.g. ".gz") is included in JSON
+		output as "format", whether selected by magic bytes or not.
+	-single
+		Read only the first member of concatenated gzip files.
+	-tolerant
+		Skip corrupt (or truncated) members of concatenated gzip files by
+		scanning for the next member, so that as much as possible is
+		recovered. Each member is buffered until its checksum is verified,
+		so nothing of a corrupt member is kept, while trailing bytes which
+		hold no further member (e.g. padding) are ignored. Files with
+		skipped members are not failed, but are warned of as incomplete on
+		stderr, marked with "skipped_members" in JSON output, and counted
+		in the summary.
+		Cannot be used with "-single" or "-stream".
+	-stream
+		Stream decompressed contents instead of buffering whole files.
+	-verify
+		Check the integrity of files (e.g. gzip checksums and lengths) by
+		reading and discarding their contents. Only the status of each file
+		is printed, and the summary counts files passed and failed. Cannot be
+		used with "-stream" or "-out".
+	-list
+		Print collected files and their sizes without processing them (up
+		to "-count", if set).
+	-timeout={duration}
+		Limit the time a single file may take to process (e.g. "30s").
+	-deadline={duration}
+		Limit the time the whole run may take (e.g. "5m"). Once exceeded,
+		remaining files are skipped and the deadline is reported once, while
+		results completed before it are still printed.
+	-ordered
+		Print results in the order files were collected.
+	-orderbuffer={n}
+		Limit how many files ahead of the next result to print may be
+		started when "-ordered" is set (default 0, no limit). Once reached,
+		newer files wait on a slow file rather than being held in memory.
+	-json
+		Print results as newline-delimited JSON objects. Failed files are
+		printed too, with empty "data" and their "error" set. Diagnostics
+		printed to stderr (e.g. errors parsing flags, startup errors,
+		cancellation, and the summary) are then printed as objects holding
+		a "message", and failed files as objects holding a "path" and
+		"error". Help requested by "-h" is still printed as plain text.
+	-csv
+		Print results as CSV rows of "path,bytes,error" following a header
+		row. The decompressed byte length is printed instead of contents.
+		Failed files are printed too, with their error. Cannot be used with
+		"-json".
+	-out={dirname}
+		Write decompressed contents to files in named directory. Files are
+		named by the original name held in gzip headers, if any. Each file
+		is written under a temporary name (e.g. ".a.txt.123.tmp") and
+		renamed once complete, so that files are never seen partly written.
+		Temporary files are removed if writing fails or is canceled.
+	-force
+		Overwrite existing files in the output directory.
+	-recompress
+		Write contents to the output directory recompressed with gzip, which
+		requires "-out". Files are named as with "-out" plus ".gz", and the
+		gzip header holds the original name and modification time.
+	-level={n}
+		Compression level used by "-recompress", from -2 (Huffman only) to 9
+		(default -1, the gzip default).
+	-maxsize={n}
+		Limit the compressed and decompressed bytes of a single file (default
+		0, no limit).
+	-maxratio={n}
+		Limit the ratio of decompressed to compressed size of a single file
+		(default 0, no limit).
+	-retries={n}
+		Retry files failing with transient errors up to n times (default 0).
+	-keeppartial
+		Keep and print the contents decompressed before a read error (e.g.
+		of a truncated file) alongside the error, for inspecting the prefix.
+		The contents are marked as partial ("partial" in JSON output), and
+		the file is still reported as failed. Cannot be used with "-out".
+	-hash={name}
+		Hash decompressed contents using "sha256", "sha1", or "md5".
+	-dedup
+		Skip files whose decompressed contents duplicate those of a file
+		already processed, as detected by "-hash". Duplicates are not
+		errors, and are counted as skipped in the summary. Cannot be used
+		with "-stream".
+	-sniff
+		Detect the content type of decompressed contents (e.g. "text/plain;
+		charset=utf-8"), which is included in JSON output. Streamed contents
+		are not sniffed.
+	-textstats
+		Count lines and validate UTF-8 of decompressed contents, which are
+		included in JSON output and totaled in the summary. Streamed
+		contents are not included.
+	-grep={regexp}
+		Filter decompressed contents to the lines matching the regular
+		expression (see the regexp package) as they are read, including
+		streamed contents and the entries of tar archives. Sizes, hashes,
+		and text statistics are of the matching lines, so combine with
+		"-skipempty" to skip files without matches.
+	-skipempty
+		Skip files which decompress to nothing (errors are still reported).
+	-failfast
+		Stop processing at the first file which fails. By default, all files
+		are processed and failures are reported at the end.
+	-quiet
+		Suppress per-file output while still printing the summary. This is
+		the same as setting "-output=null".
+	-errors-only
+		Print only the files which fail, each to stderr as it fails rather
+		than once all files are processed, while still printing the
+		summary. Successful files are not output. With the non-zero exit
+		status on any failure, this suits integrity checks in CI. Cannot be
+		used with "-out" or "-output".
+	-output={dest}
+		Print results to "stdout", "null" (discarded, e.g. for measuring
+		throughput), or a named file (default "stdout").
+	-flush={n}
+		Flush output after every n results (default 1), so that results are
+		seen as they complete when piped. A value of 0 flushes only once the
+		buffer fills and before exit.
+	-report={filename}
+		Write a JSON report of the run to named file once finished, holding
+		the totals, the path and error of each failed file, the duration,
+		the width, the flags set, and the exit status. The report is written
+		even when files fail, but not when startup fails.
+	-progress={duration}
+		Print progress to stderr at the interval (e.g. "10s"), followed by
+		the decompressed bytes copied so far of each file in progress while
+		streaming (or verifying), so that large files can be followed.
+	-heapevery={duration}
+		Print heap usage read by runtime.ReadMemStats to stderr at the
+		interval (e.g. "1s"), such as while tuning "-width".
+	-post-url={url}
+		POST the decompressed contents of each file to the URL, with the
+		path of the file held by the "X-Bigd-Path" header. Posts are made
+		by the goroutines running the digest function over pooled
+		connections, and responses other than 2xx are reported as errors of
+		the file. Failed files and duplicates are not posted. Cannot be used
+		with "-stream" or "-verify".
+	-post-concurrency={n}
+		Limit the amount of posts made at once when the endpoint is the
+		bottleneck (default 0, limited by "-width" alone).
+	-http={addr}
+		Serve "/healthz" and "/metrics" over HTTP at the address (e.g.
+		":8080") while processing. "/healthz" responds "ok", or "draining"
+		with status 503 once draining. "/metrics" serves the expvar
+		variables, including the counters under "bigd". The server is
+		started before processing and shut down gracefully once finished.
 	-slow
 		Slow processing to clarify behavior.
 	-profmem={filename}
 		Run memory profile and write to named file.
+	-profcpu={filename}
+		Run CPU profile and write to named file.
+	-trace={filename}
+		Run execution trace and write to named file.
 
 */
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codemodus/sigmon"
 	"github.com/codemodus/vitals"
+	"github.com/daved/groupthink-bigd/bigd"
+	"github.com/daved/groupthink-bigd/bigd/bigdtest"
 )
 
 const (
-	// width controls the amount of goroutines running the digest function.
-	width = 16
+	// defaultDir is the directory files are collected from when no other
+	// directory is provided.
+	defaultDir = "./testdata/"
+
+	// bootstrapFiles and bootstrapSize are the amount and decompressed size
+	// of the sample files written by "-bootstrap".
+	bootstrapFiles = 8
+	bootstrapSize  = 1024
+
+	// exitOK, exitFailed, and exitFatal are the exit statuses of a run which
+	// succeeded, a run in which files failed or processing stopped early,
+	// and a run which could not start (e.g. due to invalid flags).
+	exitOK     = 0
+	exitFailed = 1
+	exitFatal  = 2
 )
 
 var (
-	// slow enables a slowing of the digest function to aid the
-	// understanding of designed concurrency by changing the output timing.
-	slow = false
+	// errRunDeadline is reported once in place of cancellation when the run
+	// deadline passes.
+	errRunDeadline = errors.New("run deadline exceeded")
 )
 
-// filesInfo holds a slice of os.FileInfo along with the directory the
-// contents came from.
-type filesInfo struct {
-	dir string
-	fsi []os.FileInfo
+// splitList splits a comma-separated list, and drops surrounding spaces and
+// empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// jsonRequested reports whether "-json" is set within the provided command
+// line arguments of fs, which are scanned as fs would parse them, so that
+// errors parsing them can be printed as JSON.
+func jsonRequested(fs *flag.FlagSet, args []string) bool {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			return false
+		}
+
+		name := strings.TrimPrefix(a[1:], "-")
+		value, hasValue := "", false
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+
+		if name == "json" {
+			if !hasValue {
+				return true
+			}
+
+			b, err := strconv.ParseBool(value)
+			return err == nil && b
+		}
+
+		// Skip the value of a flag which takes one as the next argument.
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			continue
+		}
+		if !hasValue {
+			i++
+		}
+	}
+
+	return false
+}
+
+// dirList holds the directories set by repeated or comma-separated flags.
+type dirList []string
+
+// String implements flag.Value.
+func (l *dirList) String() string {
+	return strings.Join(*l, ",")
 }
 
-// result holds a full file path, processed data, and error (if any).
-type result struct {
-	path string
-	data string
-	err  error
+// Set implements flag.Value.
+func (l *dirList) Set(v string) error {
+	*l = append(*l, splitList(v)...)
+	return nil
 }
 
-// gzFilesInfoIn is a convenience function which grabs all gzipped files
-// within the provided directory with a depth of 1.
-func gzFilesInfoIn(dir string) (*filesInfo, error) {
-	fsi, err := ioutil.ReadDir(dir)
+// parseTime parses s as an RFC3339 timestamp, or as a duration before now
+// (e.g. "24h" is a day before now). An empty s results in a zero time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(s)
 	if err != nil {
-		return nil, err
+		return time.Time{}, fmt.Errorf("invalid time %q: not RFC3339 or a duration", s)
 	}
 
-	for k := len(fsi) - 1; k >= 0; k-- {
-		// Remove directories, and files without the correct extension.
-		if fsi[k].IsDir() || !strings.HasSuffix(fsi[k].Name(), ".gz") {
-			fsi = append(fsi[:k], fsi[k+1:]...)
-		}
+	return now.Add(-d), nil
+}
+
+// validDir returns an error if the provided directory does not exist or is
+// not a directory.
+func validDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
 	}
 
-	return &filesInfo{dir: dir, fsi: fsi}, nil
+	return nil
 }
 
-// digest processes the file located at the currently provided path, and
-// sends out a new result. It could be used, instead, to communicate with
-// relevant micorservices.
-func digest(done <-chan struct{}, paths <-chan string, c chan<- result) {
-	for p := range paths {
-		r := result{path: p}
+// bootstrapDir creates dir and writes the sample files of "-bootstrap" into
+// it.
+func bootstrapDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	_, err := bigdtest.WriteFixtures(dir, bootstrapFiles, bootstrapSize)
+	return err
+}
 
-		func() {
-			f, err := os.Open(p)
-			if err != nil {
-				r.err = err
-				return
+func main() {
+	os.Exit(run())
+}
+
+// run carries out the work of main and returns the exit status, so that
+// deferred cleanup occurs on all exit paths.
+func run() (status int) {
+	start := time.Now()
+
+	// Print diagnostics to stderr without decoration, so that output is as
+	// plain as printing directly.
+	lg := log.New(os.Stderr, "", 0)
+
+	// Ignore system signals, and return signal handling to default on
+	// return.
+	sm := sigmon.New(nil)
+	sm.Run()
+	defer sm.Stop()
+
+	// Define and parse app flags. Processing settings are held directly by
+	// the processor.
+	pr := bigd.NewProcessor()
+
+	var dirs dirList
+	flag.Var(&dirs, "dir",
+		`Directories to collect compressed files from ("-" reads stdin).`)
+	bootstrap := flag.Bool("bootstrap", false,
+		`Create the default directory with sample files if it does not exist.`)
+	stdin := flag.Bool("stdin", false,
+		`Read newline-separated file paths from stdin instead of a directory.`)
+	manifest := flag.String("manifest", "",
+		`Read files and their options from a JSON lines manifest ("-" reads stdin).`)
+	watch := flag.Bool("watch", false,
+		`Watch directories and process files as they arrive until interrupted.`)
+	flag.DurationVar(&pr.Settle, "settle", bigd.DefaultSettle,
+		`Duration a watched file must remain unchanged for before processing.`)
+	rescan := flag.Bool("rescan", false,
+		`Keep running once collected files are processed, and collect again on SIGHUP.`)
+	flag.IntVar(&pr.Depth, "depth", pr.Depth,
+		`Depth of subdirectories to collect compressed files from.`)
+	walk := flag.Bool("walk", false,
+		`Process files as they are found while collecting directories.`)
+	flag.BoolVar(&pr.Strict, "strict", false,
+		`Fail on any error while collecting, including unreadable subdirectories.`)
+	flag.IntVar(&pr.Width, "width", pr.Width,
+		`Amount of goroutines running the digest function.`)
+	serial := flag.Bool("serial", false,
+		`Process files one at a time on a single CPU (overrides width).`)
+	flag.BoolVar(&pr.Adaptive, "adaptive", false,
+		`Scale the amount of digest goroutines to the observed throughput.`)
+	flag.IntVar(&pr.MaxWidth, "maxwidth", 0,
+		`Cap the amount of digest goroutines when adaptive.`)
+	flag.BoolVar(&pr.Deterministic, "deterministic", false,
+		`Assign files to digest goroutines by index for reproducible runs.`)
+	flag.IntVar(&pr.Buffer, "buffer", 0,
+		`Amount of results held while waiting on output.`)
+	flag.Int64Var(&pr.MemBudget, "membudget", 0,
+		`Limit the total decompressed bytes held at once.`)
+	flag.IntVar(&pr.MaxOpen, "maxopen", 0,
+		`Limit the amount of files held open at once.`)
+	flag.IntVar(&pr.ReadBuffer, "readbuf", 0,
+		`Size in bytes of the buffer files are read through before decompression.`)
+	flag.Float64Var(&pr.Rate, "rate", 0,
+		`Limit the amount of files started per second.`)
+	anyExt := flag.Bool("anyext", false,
+		`Collect files regardless of extension.`)
+	extList := flag.String("ext", strings.Join(bigd.Extensions(), ","),
+		`Collect only files ending with one of the comma-separated extensions.`)
+	pattern := flag.String("pattern", "",
+		`Collect only files with names matching glob (e.g. "2024-*.gz").`)
+	since := flag.String("since", "",
+		`Collect only files modified at or after a time (RFC3339 or e.g. "24h").`)
+	until := flag.String("until", "",
+		`Collect only files modified at or before a time (RFC3339 or e.g. "1h").`)
+	minSize := flag.Int64("minsize", 0,
+		`Collect only files of at least n compressed bytes.`)
+	maxSizeC := flag.Int64("maxsize-compressed", 0,
+		`Collect only files of at most n compressed bytes.`)
+	flag.StringVar(&pr.Sort, "sort", "",
+		`Order collected files by "name", "size", or "mtime".`)
+	flag.IntVar(&pr.Count, "count", 0,
+		`Process only the first n files provided (0 is no limit).`)
+	flag.BoolVar(&pr.Follow, "follow", false,
+		`Follow symbolic links to files and directories.`)
+	flag.BoolVar(&pr.Magic, "magic", false,
+		`Select compression formats by magic bytes instead of extension.`)
+	flag.BoolVar(&pr.Single, "single", false,
+		`Read only the first member of concatenated gzip files.`)
+	flag.BoolVar(&pr.Tolerant, "tolerant", false,
+		`Skip corrupt members of concatenated gzip files, recovering the rest.`)
+	flag.BoolVar(&pr.Streaming, "stream", false,
+		`Stream decompressed contents instead of buffering whole files.`)
+	flag.BoolVar(&pr.Verify, "verify", false,
+		`Check the integrity of files without output of their contents.`)
+	list := flag.Bool("list", false,
+		`Print collected files and their sizes without processing them.`)
+	flag.DurationVar(&pr.Timeout, "timeout", 0,
+		`Limit the time a single file may take to process (e.g. "30s").`)
+	deadline := flag.Duration("deadline", 0,
+		`Limit the time the whole run may take (e.g. "5m").`)
+	flag.BoolVar(&pr.Ordered, "ordered", false,
+		`Print results in the order files were collected.`)
+	flag.IntVar(&pr.OrderBuffer, "orderbuffer", 0,
+		`Limit how many files ahead of the next result may be started when ordered.`)
+	asJSON := flag.Bool("json", false,
+		`Print results as newline-delimited JSON objects.`)
+	asCSV := flag.Bool("csv", false,
+		`Print results as CSV rows of path, byte length, and error.`)
+	out := flag.String("out", "",
+		`Write decompressed contents to files in named directory.`)
+	force := flag.Bool("force", false,
+		`Overwrite existing files in the output directory.`)
+	recompress := flag.Bool("recompress", false,
+		`Write contents to the output directory recompressed with gzip.`)
+	level := flag.Int("level", gzip.DefaultCompression,
+		`Compression level used when recompressing (-2 to 9).`)
+	flag.Int64Var(&pr.MaxSize, "maxsize", 0,
+		`Limit the compressed and decompressed bytes of a single file.`)
+	flag.Float64Var(&pr.MaxRatio, "maxratio", 0,
+		`Limit the ratio of decompressed to compressed size of a single file.`)
+	flag.IntVar(&pr.Retries, "retries", 0,
+		`Retry files failing with transient errors up to n times.`)
+	flag.BoolVar(&pr.KeepPartial, "keeppartial", false,
+		`Keep and print contents decompressed before a read error.`)
+	flag.StringVar(&pr.Hash, "hash", "",
+		`Hash decompressed contents using "sha256", "sha1", or "md5".`)
+	flag.BoolVar(&pr.Dedup, "dedup", false,
+		`Skip files whose decompressed contents duplicate an earlier file.`)
+	flag.BoolVar(&pr.Sniff, "sniff", false,
+		`Detect the content type of decompressed contents.`)
+	flag.BoolVar(&pr.TextStats, "textstats", false,
+		`Count lines and validate UTF-8 of decompressed contents.`)
+	grep := flag.String("grep", "",
+		`Filter decompressed contents to lines matching the regular expression.`)
+	flag.BoolVar(&pr.SkipEmpty, "skipempty", false,
+		`Skip files which decompress to nothing.`)
+	failFast := flag.Bool("failfast", false,
+		`Stop processing at the first file which fails.`)
+	quiet := flag.Bool("quiet", false,
+		`Suppress per-file output while still printing the summary.`)
+	errorsOnly := flag.Bool("errors-only", false,
+		`Print only failed files, to stderr as they fail, and the summary.`)
+	dest := flag.String("output", "stdout",
+		`Print results to "stdout", "null" (discarded), or a named file.`)
+	flushN := flag.Int("flush", 1,
+		`Flush output after every n results (0 flushes once the buffer fills).`)
+	reportPath := flag.String("report", "",
+		`Write a JSON report of the run to named file once finished.`)
+	progInterval := flag.Duration("progress", 0,
+		`Print progress to stderr at the interval (e.g. "10s").`)
+	heapEvery := flag.Duration("heapevery", 0,
+		`Print heap usage to stderr at the interval (e.g. "1s").`)
+	postURL := flag.String("post-url", "",
+		`POST decompressed contents of each file to the URL.`)
+	postConc := flag.Int("post-concurrency", 0,
+		`Limit the amount of posts made at once.`)
+	httpAddr := flag.String("http", "",
+		`Serve health and metrics over HTTP at the address (e.g. ":8080").`)
+	flag.BoolVar(&pr.Slow, "slow", false,
+		`Slow processing to clarify behavior.`)
+	profM := flag.String("profmem", "",
+		`Run memory profile and write to named file.`)
+	profC := flag.String("profcpu", "",
+		`Run CPU profile and write to named file.`)
+	trc := flag.String("trace", "",
+		`Run execution trace and write to named file.`)
+
+	// Parse without exiting on errors, so that they can be printed as JSON
+	// if "-json" is among the arguments (though it may follow the error).
+	// The flag package then prints nothing itself, other than help.
+	jsonArgs := jsonRequested(flag.CommandLine, os.Args[1:])
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if jsonArgs {
+		flag.CommandLine.SetOutput(ioutil.Discard)
+	}
+
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			if jsonArgs {
+				flag.CommandLine.SetOutput(os.Stderr)
+				flag.Usage()
 			}
-			defer func() {
-				_ = f.Close()
-			}()
+			return exitOK
+		}
 
-			gzr, err := gzip.NewReader(f)
-			if err != nil {
-				r.err = err
-				return
+		if jsonArgs {
+			lg.SetOutput(newJSONLog(os.Stderr))
+			lg.Println(err)
+		}
+		return exitFatal
+	}
+
+	// Print diagnostics as JSON objects if flag is set, so that stderr is
+	// as parseable as the results.
+	if *asJSON {
+		lg.SetOutput(newJSONLog(os.Stderr))
+	}
+
+	// Start CPU profile if flag is set, and stop it on return.
+	stopCPU, err := startCPUProfile(*profC)
+	if err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+	defer func() {
+		if err := stopCPU(); err != nil {
+			lg.Println(err)
+		}
+	}()
+
+	// Start execution trace if flag is set, and stop it on return.
+	stopTrace, err := startTrace(*trc)
+	if err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+	defer func() {
+		if err := stopTrace(); err != nil {
+			lg.Println(err)
+		}
+	}()
+
+	// Run serially if flag is set, so that the single-CPU case is
+	// reproduced regardless of the CPUs available.
+	if *serial {
+		if pr.Adaptive {
+			lg.Println("serial cannot be used with adaptive")
+			return exitFatal
+		}
+
+		pr.Width = 1
+		runtime.GOMAXPROCS(1)
+	}
+
+	if *manifest != "" && (*stdin || len(dirs) > 0) {
+		lg.Println("manifest cannot be used with stdin or directories")
+		return exitFatal
+	}
+
+	// Collect the default directory only if no files are named.
+	usedDefault := len(dirs) == 0 && flag.NArg() == 0
+	if usedDefault {
+		dirs = dirList{defaultDir}
+	}
+
+	for _, dir := range dirs {
+		if dir == "-" {
+			*stdin = true
+		}
+	}
+
+	if *stdin && len(dirs) > 1 {
+		lg.Println("stdin cannot be used with other directories")
+		return exitFatal
+	}
+
+	if *watch && (*stdin || *manifest != "" || *list || flag.NArg() > 0) {
+		lg.Println("watch cannot be used with stdin, manifest, list, or named files")
+		return exitFatal
+	}
+
+	if *rescan && (*watch || *stdin || *manifest != "" || *list || flag.NArg() > 0) {
+		lg.Println("rescan cannot be used with watch, stdin, manifest, list, or named files")
+		return exitFatal
+	}
+
+	if *walk && (pr.Sort != "" || *watch || *rescan) {
+		lg.Println("walk cannot be used with sort, watch, or rescan")
+		return exitFatal
+	}
+
+	// Setup collection filter.
+	pr.Filter = bigd.Filter{
+		Pattern: *pattern,
+		MinSize: *minSize,
+		MaxSize: *maxSizeC,
+	}
+	if !*anyExt {
+		pr.Filter.Exts = splitList(*extList)
+	}
+
+	if pr.Filter.Since, err = parseTime(*since, start); err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+
+	if pr.Filter.Until, err = parseTime(*until, start); err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+
+	// Compile the grep expression once, to be shared by all digesters.
+	if *grep != "" {
+		if pr.Grep, err = regexp.Compile(*grep); err != nil {
+			lg.Println(err)
+			return exitFatal
+		}
+	}
+
+	// Post results from the digesters if flag is set. This is validated
+	// along with the Processor, which rejects result callbacks while
+	// streaming.
+	if *postURL != "" {
+		if u, err := url.Parse(*postURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			lg.Printf("invalid post url %q", *postURL)
+			return exitFatal
+		}
+
+		if pr.Verify {
+			lg.Println("post url cannot be used with verify")
+			return exitFatal
+		}
+
+		if *postConc < 0 {
+			lg.Println("post concurrency must not be negative")
+			return exitFatal
+		}
+
+		pr.OnResult = bigd.NewPoster(*postURL, *postConc).Post
+	}
+
+	if err := pr.Validate(); err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+
+	if *asJSON && pr.Streaming && *out == "" {
+		lg.Println("json cannot be used while streaming")
+		return exitFatal
+	}
+
+	if pr.Verify && *out != "" {
+		lg.Println("verify cannot be used with out")
+		return exitFatal
+	}
+
+	if pr.KeepPartial && *out != "" {
+		lg.Println("keeppartial cannot be used with out")
+		return exitFatal
+	}
+
+	if *errorsOnly && (*out != "" || *dest != "stdout") {
+		lg.Println("errors-only cannot be used with out or output")
+		return exitFatal
+	}
+
+	if *asJSON && *asCSV {
+		lg.Println("json and csv cannot be used together")
+		return exitFatal
+	}
+
+	if *flushN < 0 {
+		lg.Println("flush must not be negative")
+		return exitFatal
+	}
+
+	if *recompress && *out == "" {
+		lg.Println("recompress requires out")
+		return exitFatal
+	}
+
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, *level); err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+
+	if pr.Hash != "" && pr.Streaming && *out == "" {
+		lg.Println("hash cannot be used while streaming")
+		return exitFatal
+	}
+
+	// Create the default directory with sample files if flag is set and
+	// it is missing. Existing directories are never written to.
+	if *bootstrap && usedDefault && !*stdin && *manifest == "" {
+		if _, err := os.Stat(defaultDir); os.IsNotExist(err) {
+			if err := bootstrapDir(defaultDir); err != nil {
+				lg.Println(err)
+				return exitFatal
+			}
+			lg.Printf("created %s with %d sample files", defaultDir, bootstrapFiles)
+		}
+	}
+
+	// Ensure the directories exist before doing any work. A missing default
+	// directory is explained, since it is likely a first run.
+	if !*stdin && *manifest == "" {
+		for _, dir := range dirs {
+			err := validDir(dir)
+			if usedDefault && os.IsNotExist(err) {
+				err = fmt.Errorf(`default directory %q does not exist: set "-dir", or set "-bootstrap" to create it with sample files`, defaultDir)
 			}
-			defer func() {
-				_ = gzr.Close()
-			}()
 
-			data, err := ioutil.ReadAll(gzr)
 			if err != nil {
-				r.err = err
-				return
+				lg.Println(err)
+				return exitFatal
 			}
+		}
+	}
 
-			r.data = string(data)
-		}()
+	// Create the output directory once, ahead of processing.
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			lg.Println(err)
+			return exitFatal
+		}
+	}
 
-		if slow {
-			time.Sleep(time.Second)
+	// Get sources of files from stdin, a manifest, a watcher, a rescanner,
+	// or walkers, or from populated FilesInfo types, along with any files
+	// named as arguments. Sources are interleaved so that all are read from
+	// at once. The total amount of files is unknown (-1) when reading from
+	// any but FilesInfo types and named files. Watchers and rescanners run
+	// until closed, and walkers until closed or finished.
+	var srcs []bigd.Source
+	var live []io.Closer
+	var rescanner *bigd.Rescanner
+	var walkers []*bigd.Walker
+	total := 0
+	skippedDirs := 0
+
+	switch {
+	case *manifest == "-":
+		srcs = append(srcs, bigd.NewManifestSource(os.Stdin))
+		total = -1
+	case *manifest != "":
+		f, err := os.Open(*manifest)
+		if err != nil {
+			lg.Println(err)
+			return exitFatal
 		}
+		defer f.Close()
 
-		select {
-		case c <- r:
-		case <-done:
-			return
+		srcs = append(srcs, bigd.NewManifestSource(f))
+		total = -1
+	case *stdin:
+		srcs = append(srcs, bigd.NewLineSource(os.Stdin))
+		total = -1
+	case *watch:
+		w, err := pr.Watch(dirs)
+		if err != nil {
+			lg.Println(err)
+			return exitFatal
+		}
+		defer w.Close()
+
+		srcs = append(srcs, w)
+		live = append(live, w)
+		total = -1
+	case *rescan:
+		rescanner = bigd.NewRescanner(pr, dirs)
+
+		_, skipped, err := rescanner.Rescan()
+		if err != nil {
+			lg.Println(err)
+			return exitFatal
+		}
+		defer rescanner.Close()
+
+		for _, err := range skipped {
+			lg.Println("skipping directory:", err)
+		}
+		skippedDirs += len(skipped)
+
+		srcs = append(srcs, rescanner)
+		live = append(live, rescanner)
+		total = -1
+	case *walk:
+		for _, dir := range dirs {
+			wk := pr.Walk(dir)
+			defer wk.Close()
+
+			srcs = append(srcs, wk)
+			live = append(live, wk)
+			walkers = append(walkers, wk)
+		}
+		total = -1
+	case len(dirs) > 0:
+		fsis, err := pr.FilesInfoInEach(dirs)
+		if err != nil {
+			lg.Println(err)
+			return exitFatal
+		}
+
+		for _, fsi := range fsis {
+			srcs = append(srcs, fsi.Source())
+			total += len(fsi.Files)
+
+			// Warn of unreadable subdirectories, which are counted in the
+			// summary.
+			for _, err := range fsi.Skipped {
+				lg.Println("skipping directory:", err)
+			}
+			skippedDirs += len(fsi.Skipped)
 		}
 	}
-}
 
-// funnel receives a filesInfo type, spawns goroutines (determined by the
-// const "width"), and closes
-func funnel(done <-chan struct{}, fsi *filesInfo) (<-chan result, <-chan error) {
-	c := make(chan result)
-	errc := make(chan error, 1)
+	if flag.NArg() > 0 {
+		srcs = append(srcs, bigd.NewPathSource(flag.Args()...))
+		if total >= 0 {
+			total += flag.NArg()
+		}
+	}
 
-	var wg sync.WaitGroup
-	paths := make(chan string)
+	// Only the files up to the count are processed if flag is set.
+	if pr.Count > 0 && total > pr.Count {
+		total = pr.Count
+	}
 
-	go func() {
-		// anon go func sends paths down the correct channel.
-		go func() {
-			for _, v := range fsi.fsi {
-				select {
-				case paths <- path.Join(fsi.dir, v.Name()):
-				case <-done:
-					errc <- errors.New("canceled")
-				}
+	src := bigd.Interleave(srcs...)
+
+	// Print collected files (up to the count) without processing them if
+	// flag is set.
+	if *list {
+		for n := 0; pr.Count <= 0 || n < pr.Count; n++ {
+			p, size, ok := src.Next()
+			if !ok {
+				break
 			}
 
-			close(paths)
-		}()
+			fmt.Println(p, size)
+		}
 
-		// setup digesters by width.
-		wg.Add(width)
-		for i := 0; i < width; i++ {
-			go func() {
-				digest(done, paths, c)
-				wg.Done()
-			}()
+		if err := src.Err(); err != nil {
+			lg.Println(err)
+			return exitFailed
 		}
 
-		// wait and close result channel after paths have been processed.
-		go func() {
-			wg.Wait()
-			close(c)
-		}()
-	}()
+		return exitOK
+	}
 
-	return c, errc
-}
+	// Setup the sink results are printed to, which quiet (or errors-only)
+	// replaces with one discarding them.
+	if *quiet || *errorsOnly {
+		*dest = "null"
+	}
 
-func main() {
-	// Ignore system signals.
-	sm := sigmon.New(nil)
-	sm.Run()
+	snk, closeSink, err := newSink(*dest, *asJSON, *asCSV, pr.Verify, *flushN)
+	if err != nil {
+		lg.Println(err)
+		return exitFatal
+	}
+	defer func() {
+		if err := closeSink(); err != nil {
+			lg.Println(err)
+		}
+	}()
 
-	// Define and parse app flags.
-	flag.BoolVar(&slow, "slow", false,
-		`Slow processing to clarify behavior.`)
-	profM := flag.String("profmem", "",
-		`Run memory profile and write to named file.`)
+	// Setup context for cancellation. Calling cancel more than once is a
+	// no-op, so the deferred call and the signal handler may both run.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	flag.Parse()
+	// Cancel context once the run deadline passes if flag is set. Time
+	// spent paused is not counted.
+	var dl *pausableTimer
+	if *deadline > 0 {
+		var cancelCause context.CancelCauseFunc
+		ctx, cancelCause = context.WithCancelCause(ctx)
 
-	// Get populated filesInfo type.
-	fsi, err := gzFilesInfoIn("./testdata/")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		dl = startPausableTimer(*deadline, func() {
+			cancelCause(errRunDeadline)
+		})
+		defer dl.stop()
 	}
 
-	// Setup done channel for cancellation.
-	done := make(chan struct{})
-	defer close(done)
+	// Pause and resume processing between files on the user signals.
+	pr.Gate = bigd.NewGate()
+
+	// Drain on the first interrupt by no longer starting files, and cancel
+	// context on any further interrupt or other system signal (repeated
+	// signals are harmless).
+	ds := &drainSource{Source: src, drain: make(chan struct{})}
+	var interrupts atomic.Int64
 
-	// Close done channel on any system signal.
 	sm.Set(func(sm *sigmon.SignalMonitor) {
-		close(done)
+		switch sm.Sig() {
+		case sigmon.SIGUSR1:
+			lg.Println("pausing (USR2 to resume)")
+			pr.Gate.Pause()
+			dl.pause()
+			return
+
+		case sigmon.SIGUSR2:
+			lg.Println("resuming")
+			dl.resume()
+			pr.Gate.Resume()
+			return
+
+		case sigmon.SIGHUP:
+			if rescanner == nil {
+				break
+			}
+
+			// Collect away from the handler, so that further signals
+			// are not held back by a slow collection.
+			go rescanDirs(lg, rescanner)
+			return
+		}
+
+		if sm.Sig() == sigmon.SIGINT && interrupts.Add(1) == 1 {
+			lg.Println("draining (interrupt again to cancel)")
+			ds.stop()
+			return
+		}
+
+		cancel()
 	})
 
+	// Stop watching, rescanning, or walking once draining or canceled, so
+	// that processing ends once the files already started are finished.
+	if len(live) > 0 {
+		go func() {
+			select {
+			case <-ds.drain:
+			case <-ctx.Done():
+			}
+
+			for _, c := range live {
+				_ = c.Close()
+			}
+		}()
+	}
+
+	// Serve health and metrics ahead of processing if flag is set, and shut
+	// the server down on return.
+	if *httpAddr != "" {
+		pr.Metrics = bigd.PublishMetrics("bigd")
+
+		stopHTTP, err := serveHTTP(*httpAddr, ds.drained)
+		if err != nil {
+			lg.Println(err)
+			return exitFatal
+		}
+		defer func() {
+			if err := stopHTTP(); err != nil {
+				lg.Println(err)
+			}
+		}()
+	}
+
+	// Follow the bytes copied of files in progress if flag is set, which
+	// must be set before processing starts.
+	prog := &progress{total: total, lg: lg}
+	if *progInterval > 0 {
+		pr.OnProgress = prog.copied
+	}
+
 	// Get results and error channels (is non-blocking).
-	rs, errc := funnel(done, fsi)
+	rs, errc := pr.Funnel(ctx, ds)
+
+	o := &output{
+		dir:        *out,
+		force:      *force,
+		recompress: *recompress,
+		level:      *level,
+		hash:       pr.Hash,
+		failed:     *asJSON || *asCSV,
+		sink:       snk,
+	}
+	sum := summary{start: start, verify: pr.Verify, skippedDirs: skippedDirs}
+
+	// Report progress and heap usage periodically if flags are set.
+	// Reporting is stopped before the summary is printed so that the two
+	// never interleave.
+	stopProgress := prog.start(*progInterval)
+	stopHeap := sampleHeap(lg, *heapEvery)
+	stopReports := func() {
+		stopProgress()
+		stopHeap()
+	}
+	defer stopReports()
+
+	// Output result contents, and hold results with errors to be reported
+	// after all files have been processed. Errors already printed as they
+	// occurred (if errors-only is set) are not reported again.
+	var errs []bigd.Result
+	var reported int
+
+	// Write the report on every return from here if flag is set, so that
+	// failed runs are reported too.
+	if *reportPath != "" {
+		defer func() {
+			rep := newReport(sum, errs, pr, status)
+			if err := writeReport(*reportPath, rep); err != nil {
+				lg.Println(err)
+			}
+		}()
+	}
+
+	// Cancel and drain on a panic while consuming results, so that the
+	// digesters blocked on sending are unwound (and deferred cleanup such as
+	// flushing output runs) before panicking again.
+	defer func() {
+		if v := recover(); v != nil {
+			cancel()
+			drainResults(rs)
+			panic(v)
+		}
+	}()
 
-	// Print result contents or error.
+	// Results are received until the channel is closed, even once the
+	// source has failed, so that results already in progress are output.
+	// Source errors are reported after the final result.
 	for r := range rs {
-		select {
-		case err := <-errc:
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		default:
-			fmt.Println(r.path, r.data, r.err)
+		// Skip contents already processed if flag is set.
+		if r.Duplicate {
+			r.Release()
+			sum.add(r)
+			prog.add(r)
+			continue
+		}
+
+		r = o.emit(r)
+		r.Release()
+
+		// Count files stopped by cancellation apart from failures.
+		if canceled(ctx, r) {
+			sum.canceled++
+			continue
+		}
+
+		sum.add(r)
+		prog.add(r)
+
+		// Warn of files recovered only in part if tolerant.
+		if r.SkippedMembers > 0 {
+			lg.Printf("%s incomplete: %d corrupt gzip members skipped", r.Path, r.SkippedMembers)
+		}
+
+		if r.Err != nil {
+			errs = append(errs, r)
+
+			if *errorsOnly {
+				reportErrors(lg, errs[reported:])
+				reported = len(errs)
+			}
+
+			// Stop at the first failing file if flag is set, and
+			// cancel the files still in progress on return.
+			if *failFast {
+				stopReports()
+				reportErrors(lg, errs[reported:])
+				lg.Println(sum)
+				lg.Println("stopped at first error")
+				return exitFailed
+			}
+		}
+	}
+
+	stopReports()
+
+	// Warn of unreadable subdirectories found while walking, which are
+	// only known once each walk has finished. Walks still running (e.g.
+	// once the count is reached) are stopped first.
+	for _, wk := range walkers {
+		_ = wk.Close()
+
+		for _, err := range wk.Skipped() {
+			lg.Println("skipping directory:", err)
 		}
+		sum.skippedDirs += len(wk.Skipped())
+	}
+
+	// Report any error which ended processing early (e.g. a failing
+	// source), which is received before the results channel is closed.
+	select {
+	case err := <-errc:
+		reportErrors(lg, errs[reported:])
+		lg.Println(sum)
+		lg.Println(runError(ctx, err))
+		return exitFailed
+	default:
 	}
 
 	// Write heap profile if flag is set.
 	if err := vitals.WriteHeapProfile(*profM); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		lg.Println(err)
+		return exitFailed
+
+	}
+
+	reportErrors(lg, errs[reported:])
+	lg.Println(sum)
+
+	if context.Cause(ctx) == errRunDeadline {
+		lg.Println(errRunDeadline)
+		return exitFailed
+	}
+
+	if ds.drained() {
+		lg.Println("drained")
+		return exitFailed
+	}
 
+	// Report cancellation which arrived once all files were provided (e.g.
+	// while watching).
+	if err := ctx.Err(); err != nil {
+		lg.Println(err)
+		return exitFailed
+	}
+
+	if len(errs) > 0 {
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+// rescanDirs collects the directories of rs again, and prints the amount of
+// files found which were not seen before, along with any skipped
+// directories or error, to lg.
+func rescanDirs(lg *log.Logger, rs *bigd.Rescanner) {
+	n, skipped, err := rs.Rescan()
+	if err != nil {
+		lg.Println("rescan failed:", err)
+		return
+	}
+
+	for _, err := range skipped {
+		lg.Println("skipping directory:", err)
+	}
+
+	lg.Printf("rescanned: %d new files", n)
+}
+
+// runError returns errRunDeadline in place of err if the run deadline of
+// ctx has passed.
+func runError(ctx context.Context, err error) error {
+	if context.Cause(ctx) == errRunDeadline {
+		return errRunDeadline
+	}
+
+	return err
+}
+
+// canceled reports whether ctx was canceled (e.g. by the run deadline or a
+// signal) and r failed because of it, in which case r is counted as
+// canceled rather than reported as failed.
+func canceled(ctx context.Context, r bigd.Result) bool {
+	return ctx.Err() != nil && errors.Is(r.Err, context.Canceled)
+}
+
+// pausableTimer calls a function once its duration has elapsed, excluding
+// any time spent paused. A nil pausableTimer is a no-op.
+type pausableTimer struct {
+	mu     sync.Mutex
+	t      *time.Timer
+	left   time.Duration
+	start  time.Time
+	paused bool
+	fired  bool
+}
+
+// startPausableTimer returns a running pausableTimer which calls fn once d
+// has elapsed.
+func startPausableTimer(d time.Duration, fn func()) *pausableTimer {
+	pt := &pausableTimer{left: d, start: time.Now()}
+	pt.t = time.AfterFunc(d, fn)
+
+	return pt
+}
+
+// pause stops the timer, and holds the time left. Pausing a paused timer is
+// harmless.
+func (pt *pausableTimer) pause() {
+	if pt == nil {
+		return
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if pt.paused {
+		return
+	}
+	pt.paused = true
+
+	if !pt.t.Stop() {
+		pt.fired = true
+		return
+	}
+	pt.left -= time.Since(pt.start)
+}
+
+// resume restarts the timer with the time left. Resuming a running timer is
+// harmless.
+func (pt *pausableTimer) resume() {
+	if pt == nil {
+		return
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if !pt.paused {
+		return
+	}
+	pt.paused = false
+
+	if !pt.fired {
+		pt.start = time.Now()
+		pt.t.Reset(pt.left)
+	}
+}
+
+// stop stops the timer for good.
+func (pt *pausableTimer) stop() {
+	if pt == nil {
+		return
+	}
+
+	pt.t.Stop()
+}
+
+// startCPUProfile starts a CPU profile which is written to the named file,
+// and returns a function which stops the profile and closes the file. An
+// empty name results in a no-op.
+func startCPUProfile(name string) (func() error, error) {
+	return startRecording(name, pprof.StartCPUProfile, pprof.StopCPUProfile)
+}
+
+// startTrace starts an execution trace which is written to the named file,
+// and returns a function which stops the trace and closes the file. An
+// empty name results in a no-op.
+func startTrace(name string) (func() error, error) {
+	return startRecording(name, trace.Start, trace.Stop)
+}
+
+// startRecording creates the named file and calls start with it, and
+// returns a function which calls stop and closes the file. An empty name
+// results in a no-op.
+func startRecording(name string, start func(io.Writer) error, stop func()) (func() error, error) {
+	if name == "" {
+		return func() error { return nil }, nil
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := start(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		stop()
+		return f.Close()
+	}, nil
+}
+
+// httpShutdownTimeout limits the time an HTTP server waits for open
+// requests to finish once shut down.
+const httpShutdownTimeout = 5 * time.Second
+
+// serveHTTP serves "/healthz" and "/metrics" at the provided address, and
+// returns a function which shuts the server down gracefully. Health is
+// reported as unavailable once draining reports true. The address is
+// listened on before returning, so that errors are reported at startup.
+func serveHTTP(addr string, draining func() bool) (func() error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/metrics", expvar.Handler())
+
+	srv := &http.Server{Handler: mux}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ln)
+	}()
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+
+		if err := <-done; err != http.ErrServerClosed {
+			return err
+		}
+
+		return nil
+	}, nil
+}
+
+// output holds the settings which control how results are output. Failed
+// enables the writing of failed results to the sink, for structured output
+// which holds their errors.
+type output struct {
+	dir        string
+	force      bool
+	recompress bool
+	level      int
+	hash       string
+	failed     bool
+	sink       sink
+}
+
+// emit writes the result contents to the output directory (if set), and
+// then writes the result to the sink. The result is returned updated with
+// any error and the decompressed size of streamed contents. Results with
+// errors are not output, other than those holding partial contents, unless
+// failed results are enabled, in which case they are written to the sink
+// without contents. When writing to the output directory, the written file
+// name takes the place of the contents.
+func (o *output) emit(r bigd.Result) bigd.Result {
+	if r.Stream != nil {
+		defer func(rc io.Closer) {
+			_ = rc.Close()
+		}(r.Stream)
+	}
+
+	if r.Partial {
+		if err := o.sink.Write(r); err != nil {
+			r.Err = err
+		}
+		return r
+	}
+
+	if r.Err != nil {
+		return o.emitFailed(r)
+	}
+
+	if o.dir != "" {
+		var src io.Reader = strings.NewReader(r.Data)
+		var h hash.Hash
+		if r.Stream != nil {
+			src = r.Stream
+
+			if o.hash != "" {
+				h, _ = bigd.NewHash(o.hash)
+				src = io.TeeReader(src, h)
+			}
+		}
+
+		name := outputName(r)
+		var enc func(io.Writer) io.WriteCloser
+		if o.recompress {
+			name += ".gz"
+			enc = o.gzipEncoder(r)
+		}
+
+		var dst string
+		var n int64
+		dst, n, r.Err = writeOutput(o.dir, name, src, o.force, enc)
+		if r.Stream != nil {
+			r.DataSize = n
+			r.Stream = nil
+		}
+
+		if r.Err != nil {
+			return o.emitFailed(r)
+		}
+
+		if h != nil {
+			r.Hash = hex.EncodeToString(h.Sum(nil))
+		}
+
+		r.Data = dst
+	}
+
+	if r.Stream == nil {
+		r.Err = o.sink.Write(r)
+		return r
+	}
+
+	cr := &countReader{Reader: r.Stream}
+	r.Stream = ioutil.NopCloser(cr)
+	r.Err = o.sink.Write(r)
+	r.DataSize = cr.n
+
+	return r
+}
+
+// emitFailed writes the failed result to the sink without contents, if
+// failed results are enabled, and returns the result updated with any error
+// of the sink.
+func (o *output) emitFailed(r bigd.Result) bigd.Result {
+	if !o.failed {
+		return r
+	}
+
+	fr := r
+	fr.Data, fr.Stream = "", nil
+	if err := o.sink.Write(fr); err != nil {
+		r.Err = err
+	}
+
+	return r
+}
+
+// gzipEncoder returns a function which wraps a writer with a gzip writer at
+// the output level. The gzip header holds the original name and
+// modification time of r, so that both survive the round trip.
+func (o *output) gzipEncoder(r bigd.Result) func(io.Writer) io.WriteCloser {
+	return func(w io.Writer) io.WriteCloser {
+		gzw, _ := gzip.NewWriterLevel(w, o.level) // level validated upfront
+		gzw.Name = outputName(r)
+
+		if r.Header != nil {
+			gzw.Comment = r.Header.Comment
+			gzw.ModTime = r.Header.ModTime
+		}
+
+		return gzw
+	}
+}
+
+// sink receives each successfully processed result for output. Streamed
+// contents must be fully read by Write.
+type sink interface {
+	Write(r bigd.Result) error
+}
+
+// newSink returns the sink selected by dest and the format flags, and a
+// function which flushes the sink and closes its destination. If verify is
+// set, text output holds only the status of each file. A dest of
+// "stdout" (or empty) writes to stdout, "null" discards results, and any
+// other dest names a file which is created (or truncated). Output is
+// buffered and flushed after every flush results, or only once the buffer
+// fills if flush is 0.
+func newSink(dest string, asJSON, asCSV, verify bool, flush int) (sink, func() error, error) {
+	nop := func() error { return nil }
+
+	var w io.Writer
+	closeFn := nop
+
+	switch dest {
+	case "", "stdout":
+		w = os.Stdout
+	case "null":
+		return discardSink{}, nop, nil
+	default:
+		f, err := os.Create(dest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		w, closeFn = f, f.Close
+	}
+
+	bw := bufio.NewWriter(w)
+	fs := &flushSink{every: flush, flush: bw.Flush}
+
+	switch {
+	case asJSON:
+		fs.sink = jsonSink{enc: json.NewEncoder(bw)}
+
+	case asCSV:
+		cw := csv.NewWriter(bw)
+		if err := cw.Write([]string{"path", "bytes", "error"}); err != nil {
+			_ = closeFn()
+			return nil, nil, err
+		}
+
+		fs.sink = csvSink{w: cw}
+		fs.flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+
+			return bw.Flush()
+		}
+
+	default:
+		fs.sink = textSink{w: bw, verify: verify}
+	}
+
+	return fs, func() error {
+		if err := fs.flush(); err != nil {
+			_ = closeFn()
+			return err
+		}
+
+		return closeFn()
+	}, nil
+}
+
+// flushSink wraps a sink so that its buffered output is flushed after
+// every so many results, which lets consumers of the output (e.g. a pipe)
+// see results as they complete. An every of 0 leaves flushing to the
+// buffer and the final flush.
+type flushSink struct {
+	sink
+	every int
+	flush func() error
+	n     int
+}
+
+// Write implements sink.
+func (s *flushSink) Write(r bigd.Result) error {
+	if err := s.sink.Write(r); err != nil {
+		return err
+	}
+
+	s.n++
+	if s.every > 0 && s.n%s.every == 0 {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// textSink writes each result as a line holding its path, hash (if any) or
+// "partial" (if the contents were only partly read), contents, and error.
+// Streamed contents are copied as they are read. If verify is set, each
+// line holds the path, hash (if any), and "ok".
+type textSink struct {
+	w      io.Writer
+	verify bool
+}
+
+// Write implements sink.
+func (s textSink) Write(r bigd.Result) error {
+	if s.verify {
+		if r.Hash != "" {
+			_, err := fmt.Fprintln(s.w, r.Path, r.Hash, "ok")
+			return err
+		}
+
+		_, err := fmt.Fprintln(s.w, r.Path, "ok")
+		return err
+	}
+
+	if r.Stream != nil {
+		if _, err := fmt.Fprint(s.w, r.Path, " "); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(s.w, r.Stream)
+		if _, perr := fmt.Fprintln(s.w, "", err); err == nil {
+			err = perr
+		}
+
+		return err
+	}
+
+	if r.Hash != "" {
+		_, err := fmt.Fprintln(s.w, r.Path, r.Hash, r.Data, r.Err)
+		return err
+	}
+
+	if r.Partial {
+		_, err := fmt.Fprintln(s.w, r.Path, "partial", r.Data, r.Err)
+		return err
+	}
+
+	_, err := fmt.Fprintln(s.w, r.Path, r.Data, r.Err)
+	return err
+}
+
+// jsonSink writes each result as a newline-delimited JSON object.
+type jsonSink struct {
+	enc *json.Encoder
+}
+
+// Write implements sink.
+func (s jsonSink) Write(r bigd.Result) error {
+	return s.enc.Encode(r)
+}
+
+// csvSink writes each result as a CSV row holding its path, decompressed
+// byte length, and error. Contents are left out since they may be large.
+type csvSink struct {
+	w *csv.Writer
+}
+
+// Write implements sink.
+func (s csvSink) Write(r bigd.Result) error {
+	n := r.DataSize
+	if r.Stream != nil {
+		var err error
+		if n, err = io.Copy(ioutil.Discard, r.Stream); err != nil {
+			return err
+		}
+	}
+
+	var msg string
+	if r.Err != nil {
+		msg = r.Err.Error()
+	}
+
+	if err := s.w.Write([]string{r.Path, strconv.FormatInt(n, 10), msg}); err != nil {
+		return err
+	}
+
+	return s.w.Error()
+}
+
+// discardSink reads and drops each result, which leaves only the cost of
+// processing (e.g. for measuring decompression throughput).
+type discardSink struct{}
+
+// Write implements sink.
+func (discardSink) Write(r bigd.Result) error {
+	if r.Stream == nil {
+		return nil
+	}
+
+	_, err := io.Copy(ioutil.Discard, r.Stream)
+	return err
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	io.Reader
+	n int64
+}
+
+// Read implements io.Reader.
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// summary holds the totals of a run. If verify is set, files without
+// errors are reported as passed and the others as failed. Text totals are
+// reported if any result held text statistics, and skipped duplicates and
+// directories, and canceled files, if any were found.
+type summary struct {
+	files  int
+	errs   int
+	csize  int64
+	dsize  int64
+	start  time.Time
+	verify bool
+
+	texts   int
+	lines   int64
+	nonUTF8 int
+
+	dups        int
+	skippedDirs int
+	canceled    int
+	incomplete  int
+}
+
+// add includes the provided result in the totals.
+func (s *summary) add(r bigd.Result) {
+	s.files++
+	s.csize += r.Size
+	s.dsize += r.DataSize
+
+	if r.Err != nil {
+		s.errs++
+	}
+
+	if r.Duplicate {
+		s.dups++
+	}
+
+	if r.SkippedMembers > 0 {
+		s.incomplete++
+	}
+
+	if r.Text != nil {
+		s.texts++
+		s.lines += r.Text.Lines
+
+		if !r.Text.UTF8 {
+			s.nonUTF8++
+		}
+	}
+}
+
+// String implements fmt.Stringer.
+func (s summary) String() string {
+	var text string
+	if s.texts > 0 {
+		text = fmt.Sprintf(", %d lines, %d files not UTF-8", s.lines, s.nonUTF8)
+	}
+
+	if s.dups > 0 {
+		text += fmt.Sprintf(", %d duplicates skipped", s.dups)
+	}
+
+	if s.skippedDirs > 0 {
+		text += fmt.Sprintf(", %d directories skipped", s.skippedDirs)
+	}
+
+	if s.canceled > 0 {
+		text += fmt.Sprintf(", %d canceled", s.canceled)
+	}
+
+	if s.incomplete > 0 {
+		text += fmt.Sprintf(", %d incomplete", s.incomplete)
+	}
+
+	if s.verify {
+		return fmt.Sprintf(
+			"%d files verified, %d passed, %d failed, %d bytes read, %d bytes decompressed%s, %s elapsed",
+			s.files, s.files-s.errs, s.errs, s.csize, s.dsize, text, time.Since(s.start),
+		)
+	}
+
+	return fmt.Sprintf(
+		"%d files processed, %d errors, %d bytes read, %d bytes decompressed%s, %s elapsed",
+		s.files, s.errs, s.csize, s.dsize, text, time.Since(s.start),
+	)
+}
+
+// drainSource wraps a Source so that no further files are provided once
+// stop has been called, which lets files already started finish normally.
+type drainSource struct {
+	bigd.Source
+	drain chan struct{}
+	once  sync.Once
+}
+
+// Next implements bigd.Source.
+func (s *drainSource) Next() (string, int64, bool) {
+	if s.drained() {
+		return "", 0, false
+	}
+
+	return s.Source.Next()
+}
+
+// stop ends the source. It may be called more than once.
+func (s *drainSource) stop() {
+	s.once.Do(func() {
+		close(s.drain)
+	})
+}
+
+// drained reports whether stop has been called.
+func (s *drainSource) drained() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Options implements bigd.OptionsSource, passing on the options of the
+// wrapped source (if any).
+func (s *drainSource) Options() bigd.Options {
+	if src, ok := s.Source.(bigd.OptionsSource); ok {
+		return src.Options()
+	}
+
+	return bigd.Options{}
+}
+
+// progress holds counters which are reported periodically to lg while
+// results are output. The counters are updated by the consumer of results
+// and read by a separate reporting goroutine. A negative total is treated
+// as unknown. The bytes copied of files in progress (see copied) are
+// reported along with the counters, one file per line.
+type progress struct {
+	total int
+	lg    *log.Logger
+	files atomic.Int64
+	errs  atomic.Int64
+
+	mu      sync.Mutex
+	current map[string]int64
+}
+
+// add includes the provided result in the counters, and ends the progress
+// of its file.
+func (p *progress) add(r bigd.Result) {
+	p.files.Add(1)
+
+	if r.Err != nil {
+		p.errs.Add(1)
+	}
+
+	p.mu.Lock()
+	delete(p.current, r.Path)
+	p.mu.Unlock()
+}
+
+// copied records the amount of bytes copied so far of the file located at
+// path. It satisfies bigd.Processor.OnProgress.
+func (p *progress) copied(path string, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil {
+		p.current = make(map[string]int64)
+	}
+	p.current[path] = n
+}
+
+// print prints the counters to lg, followed by the bytes copied of each
+// file in progress in name order.
+func (p *progress) print() {
+	p.lg.Println(p)
+
+	p.mu.Lock()
+	paths := make([]string, 0, len(p.current))
+	for path := range p.current {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	lines := make([]string, len(paths))
+	for i, path := range paths {
+		lines[i] = fmt.Sprintf("  %s %d bytes", path, p.current[path])
+	}
+	p.mu.Unlock()
+
+	for _, line := range lines {
+		p.lg.Println(line)
+	}
+}
+
+// String implements fmt.Stringer.
+func (p *progress) String() string {
+	if p.total < 0 {
+		return fmt.Sprintf(
+			"processed %d files, %d errors",
+			p.files.Load(), p.errs.Load(),
+		)
+	}
+
+	return fmt.Sprintf(
+		"processed %d/%d files, %d errors",
+		p.files.Load(), p.total, p.errs.Load(),
+	)
+}
+
+// start prints the progress at the provided interval, and returns
+// a function which stops the reporting and waits for it to finish. The
+// returned function may be called more than once. An interval of 0 results
+// in a no-op.
+func (p *progress) start(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				p.print()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+}
+
+// sampleHeap prints the heap usage read by runtime.ReadMemStats to lg at
+// the provided interval, and returns a function which stops the sampling
+// and waits for it to finish. The returned function may be called more
+// than once. An interval of 0 results in a no-op.
+func sampleHeap(lg *log.Logger, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		var ms runtime.MemStats
+		for {
+			select {
+			case <-t.C:
+				runtime.ReadMemStats(&ms)
+				lg.Printf(
+					"heap: %d bytes allocated, %d bytes in use, %d bytes from system, %d GCs",
+					ms.Alloc, ms.HeapInuse, ms.HeapSys, ms.NumGC,
+				)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+}
+
+// outputName returns the original file name held by the gzip header of r,
+// or, if none is held, the base of the path of r without its compression
+// extension. Names without a supported extension are returned unchanged.
+// Only the base of a header name is used so that files cannot be written
+// outside of the output directory.
+func outputName(r bigd.Result) string {
+	if r.Header != nil && r.Header.Name != "" {
+		name := path.Base(strings.ReplaceAll(r.Header.Name, "\\", "/"))
+		if name != "." && name != ".." && name != "/" {
+			return name
+		}
+	}
+
+	name := path.Base(r.Path)
+
+	ext := path.Ext(name)
+	for _, e := range bigd.Extensions() {
+		if e == ext {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+
+	return name
+}
+
+// writeOutput copies the contents of r to a file within dir which is named
+// by name, encoded by enc if it is not nil. The full path of the written
+// file and the amount of bytes copied from r are returned. An existing file
+// is an error unless force is set. Contents are written to a temporary file
+// within dir which is renamed into place once complete, so that partially
+// written files are never seen under the name. The temporary file is
+// removed on error.
+func writeOutput(dir, name string, r io.Reader, force bool, enc func(io.Writer) io.WriteCloser) (string, int64, error) {
+	dst := path.Join(dir, name)
+
+	if !force {
+		if _, err := os.Lstat(dst); err == nil {
+			return dst, 0, &os.PathError{Op: "open", Path: dst, Err: os.ErrExist}
+		}
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".*.tmp")
+	if err != nil {
+		return dst, 0, err
+	}
+
+	fail := func(err error) error {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	var w io.Writer = f
+	var ew io.WriteCloser
+	if enc != nil {
+		ew = enc(f)
+		w = ew
+	}
+
+	n, err := io.Copy(w, r)
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err != nil {
+		return dst, n, fail(err)
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return dst, n, err
+	}
+
+	if err := os.Rename(f.Name(), dst); err != nil {
+		_ = os.Remove(f.Name())
+		return dst, n, err
+	}
+
+	return dst, n, nil
+}
+
+// drainResults receives the remaining results until rs is closed, closing
+// any streams and releasing any memory held, so that the digesters sending
+// them can return.
+func drainResults(rs <-chan bigd.Result) {
+	for r := range rs {
+		if r.Stream != nil {
+			_ = r.Stream.Close()
+		}
+		r.Release()
+	}
+}
+
+// reportErrors prints the path and error of each provided result to lg.
+// If lg prints JSON (see jsonLog), each is printed as a failure object.
+func reportErrors(lg *log.Logger, errs []bigd.Result) {
+	jl, _ := lg.Writer().(*jsonLog)
+
+	for _, r := range errs {
+		if jl != nil {
+			jl.encode(failure{Path: r.Path, Error: r.Err.Error()})
+			continue
+		}
+
+		lg.Println(r.Path, r.Err)
+	}
+}
+
+// jsonLog writes each message printed by a log.Logger as a JSON object
+// holding the message (e.g. {"message":"draining"}), one per line.
+type jsonLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newJSONLog returns a jsonLog writing to w.
+func newJSONLog(w io.Writer) *jsonLog {
+	return &jsonLog{enc: json.NewEncoder(w)}
+}
+
+// Write implements io.Writer. Each call is expected to hold one message, as
+// with a log.Logger.
+func (jl *jsonLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	if err := jl.encode(struct {
+		Message string `json:"message"`
+	}{msg}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// encode writes v as a JSON object, serialized with messages.
+func (jl *jsonLog) encode(v any) error {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	return jl.enc.Encode(v)
+}
+
+// report summarizes a run for machine consumption (e.g. by CI), along with
+// the settings needed to reproduce it.
+type report struct {
+	Files      int               `json:"files"`
+	Succeeded  int               `json:"succeeded"`
+	Failed     int               `json:"failed"`
+	Failures   []failure         `json:"failures"`
+	Duplicates int               `json:"duplicates"`
+	BytesIn    int64             `json:"bytes_in"`
+	BytesOut   int64             `json:"bytes_out"`
+	Duration   float64           `json:"duration_seconds"`
+	Width      int               `json:"width"`
+	Flags      map[string]string `json:"flags"`
+	ExitStatus int               `json:"exit_status"`
+}
+
+// failure holds the path and error of a file which failed to process.
+type failure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// newReport returns a report of the run described by the summary, the
+// results with errors, the settings of pr, and the exit status. Only flags
+// which were set are included.
+func newReport(s summary, errs []bigd.Result, pr *bigd.Processor, status int) report {
+	width := pr.Width
+	if width < 1 {
+		width = bigd.DefaultWidth
+	}
+
+	rep := report{
+		Files:      s.files,
+		Succeeded:  s.files - s.errs,
+		Failed:     s.errs,
+		Failures:   make([]failure, 0, len(errs)),
+		Duplicates: s.dups,
+		BytesIn:    s.csize,
+		BytesOut:   s.dsize,
+		Duration:   time.Since(s.start).Seconds(),
+		Width:      width,
+		Flags:      map[string]string{},
+		ExitStatus: status,
+	}
+
+	for _, r := range errs {
+		rep.Failures = append(rep.Failures, failure{Path: r.Path, Error: r.Err.Error()})
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		rep.Flags[f.Name] = f.Value.String()
+	})
+
+	return rep
+}
+
+// writeReport writes rep as an indented JSON document to the named file,
+// which is created (or truncated).
+func writeReport(name string, rep report) error {
+	b, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
 	}
 
-	// Return system signal handling to default.
-	sm.Stop()
+	return ioutil.WriteFile(name, append(b, '\n'), 0644)
 }
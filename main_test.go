@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mainArgsEnv holds the arguments main is run with when the test binary is
+// started as a subprocess by a test.
+const mainArgsEnv = "BIGD_TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{"bigd"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// startMain starts main in a subprocess with the provided arguments, and
+// returns the command along with its captured stderr.
+func startMain(t *testing.T, args string) (*exec.Cmd, *bytes.Buffer) {
+	t.Helper()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+args)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return cmd, &stderr
+}
+
+func TestSignalsDoNotPanic(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not sent on windows")
+	}
+
+	tests := []struct {
+		name string
+		sigs []os.Signal
+	}{
+		{"interrupt", []os.Signal{os.Interrupt}},
+		{"interrupt twice", []os.Signal{os.Interrupt, os.Interrupt}},
+		{"terminate", []os.Signal{syscall.SIGTERM}},
+		{"interrupt then terminate", []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGTERM}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, stderr := startMain(t, "-slow -width 2")
+
+			// Give the signal handler time to be set, and files time to
+			// be started.
+			time.Sleep(500 * time.Millisecond)
+
+			for _, sig := range tt.sigs {
+				if err := cmd.Process.Signal(sig); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				_ = cmd.Process.Kill()
+				<-done
+				t.Fatalf("run did not end after signals; stderr:\n%s", stderr)
+			}
+
+			if strings.Contains(stderr.String(), "panic") {
+				t.Fatalf("run panicked; stderr:\n%s", stderr)
+			}
+
+			// A run stopped early exits non-zero, but not by the signal
+			// itself, which would mean it went unhandled.
+			ee, ok := err.(*exec.ExitError)
+			if !ok {
+				t.Fatalf("got exit error %v, want a non-zero exit status", err)
+			}
+			if code := ee.ExitCode(); code != exitFailed {
+				t.Fatalf("got exit status %d, want %d; stderr:\n%s", code, exitFailed, stderr)
+			}
+		})
+	}
+}
+
+func TestFlagErrorsAsJSON(t *testing.T) {
+	tests := []string{
+		"-json -bogus",
+		"-bogus -json",
+		"-dir testdata -json -width nope",
+	}
+
+	for _, args := range tests {
+		t.Run(args, func(t *testing.T) {
+			cmd, stderr := startMain(t, args)
+
+			err := cmd.Wait()
+			if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != exitFatal {
+				t.Fatalf("got exit error %v, want exit status %d", err, exitFatal)
+			}
+
+			lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got %d lines on stderr, want 1:\n%s", len(lines), stderr)
+			}
+
+			var msg struct{ Message string }
+			if err := json.Unmarshal([]byte(lines[0]), &msg); err != nil || msg.Message == "" {
+				t.Fatalf("got stderr %q, want a JSON message", lines[0])
+			}
+		})
+	}
+}